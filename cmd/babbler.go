@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"fmt"
+	vfs "fs"
 	"fs/memfs"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -34,15 +36,18 @@ func (c *command) Run(args []string) {
 
 // Babbler - filesystem's talker
 type Babbler struct {
-	fspath   string
-	mounted  *memfs.MemFS
+	vfs      *vfs.VFS
 	commands map[string]*command
+	// servers and watchers of filesystems, closed on umount
+	closers map[vfs.Filesystem][]io.Closer
 }
 
 // Babble - create new bubbler
 func Babble() *Babbler {
 	b := &Babbler{
+		vfs:      vfs.NewVFS(),
 		commands: make(map[string]*command),
+		closers:  make(map[vfs.Filesystem][]io.Closer),
 	}
 
 	b.Command("help", 0, func(args []string) error {
@@ -77,7 +82,7 @@ func (b *Babbler) Exec(input string) {
 		return
 	}
 
-	if name != "mount" && name != "help" && b.mounted == nil {
+	if name != "mount" && name != "overlay" && name != "help" && !b.mounted() {
 		red.Println("no filesystem mounted")
 		return
 	}
@@ -107,9 +112,40 @@ func (b *Babbler) Run() {
 	}
 }
 
+// memfs returns MemFS and path inside it of name
+func (b *Babbler) memfs(name string) (*memfs.MemFS, string, error) {
+	fs, rel, err := b.vfs.Resolve(name)
+	if err != nil {
+		return nil, "", err
+	}
+	m, ok := fs.(*memfs.MemFS)
+	if !ok {
+		return nil, "", fmt.Errorf("%s isn't a memfs filesystem", name)
+	}
+	return m, rel, nil
+}
+
+// mounted checks if anything is mounted
+func (b *Babbler) mounted() bool {
+	return len(b.vfs.Mounts()) > 0
+}
+
+// current returns MemFS holding the working directory
+func (b *Babbler) current() (*memfs.MemFS, error) {
+	fs, _, err := b.vfs.Resolve(b.vfs.Pwd())
+	if err != nil {
+		return nil, err
+	}
+	m, ok := fs.(*memfs.MemFS)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a memfs filesystem", b.vfs.Pwd())
+	}
+	return m, nil
+}
+
 func (b *Babbler) line() {
-	if b.mounted != nil {
-		blue.Print(b.mounted.Pwd() + " ")
+	if b.mounted() {
+		blue.Print(b.vfs.Pwd() + " ")
 		cyan.Print("$ ")
 	} else {
 		cyan.Print("$ ")
@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
+	vfs "fs"
+	"fs/dav"
 	"fs/memfs"
+	"fs/osfs"
+	"fs/overlay"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 )
@@ -23,7 +29,7 @@ func main() {
 	b := Babble()
 
 	b.Command("ls", 0, func(args []string) error {
-		for _, f := range b.mounted.List() {
+		for _, f := range b.vfs.List() {
 			if f.IsDir() {
 				cyan.Printf("%4d %s\n", f.ID(), f.Name())
 			} else {
@@ -34,11 +40,11 @@ func main() {
 	})
 
 	b.Command("create", 1, func(args []string) error {
-		return b.mounted.Create(args[0])
+		return b.vfs.Create(args[0])
 	})
 
 	b.Command("open", 1, func(args []string) error {
-		fd, err := b.mounted.Open(args[0])
+		fd, err := b.vfs.Open(args[0])
 		if err != nil {
 			return err
 		}
@@ -47,15 +53,15 @@ func main() {
 	})
 
 	b.Command("mkdir", 1, func(args []string) error {
-		return b.mounted.Mkdir(args[0])
+		return b.vfs.Mkdir(args[0])
 	})
 
 	b.Command("cd", 1, func(args []string) error {
-		return b.mounted.Cd(args[0])
+		return b.vfs.Cd(args[0])
 	})
 
 	b.Command("pwd", 0, func(args []string) error {
-		fmt.Println(b.mounted.Pwd())
+		fmt.Println(b.vfs.Pwd())
 		return nil
 	})
 
@@ -65,50 +71,288 @@ func main() {
 			return err
 		}
 
-		info, err := b.mounted.Stat(id)
+		info, err := b.vfs.Stat(id)
 		if err != nil {
 			return nil
 		}
 
-		temp := "File: %s Size: %d Mode %s"
+		var links int
+		if n, ok := info.(interface{ Nlink() int }); ok {
+			links = n.Nlink()
+		}
+
+		temp := "File: %s Size: %d Links: %d Mode %s"
 		if info.IsDir() {
 			temp += " directory\n"
 		} else {
 			temp += " regular file\n"
 		}
-		fmt.Printf(temp, info.Name(), info.Size(), info.Mode())
+		fmt.Printf(temp, info.Name(), info.Size(), links, info.Mode())
+
+		if t, ok := info.(interface {
+			AccessTime() time.Time
+			ChangeTime() time.Time
+			BirthTime() time.Time
+		}); ok {
+			fmt.Printf("Access: %s\n", t.AccessTime())
+			fmt.Printf("Modify: %s\n", info.ModTime())
+			fmt.Printf("Change: %s\n", t.ChangeTime())
+			fmt.Printf(" Birth: %s\n", t.BirthTime())
+		}
 		return nil
 	})
 
-	b.Command("unmount", 0, func(args []string) error {
-		defer func() { b.mounted = nil }()
-		return memfs.Save(b.fspath, b.mounted)
+	b.Command("umount", 1, func(args []string) error {
+		// optional argument is count of backups to keep
+		var opts memfs.SaveOptions
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+			opts.Backups = n
+		}
+
+		// filesystem stays mounted if it isn't saved, so nothing is lost
+		return b.vfs.Umount(args[0], func(fs vfs.Filesystem) error {
+			for _, c := range b.closers[fs] {
+				c.Close()
+			}
+			delete(b.closers, fs)
+
+			m, ok := fs.(*memfs.MemFS)
+			if o, isOverlay := fs.(*overlay.FS); isOverlay {
+				// changes not committed are dropped with the upper layer
+				m, ok = o.Lower(), true
+			}
+			if !ok {
+				return nil
+			}
+			if err := m.Unmount(opts); err != memfs.ErrNotMounted {
+				return err
+			}
+			return nil
+		})
 	})
 
 	b.Command("mount", 1, func(args []string) error {
-		fs, err := memfs.Load(args[0])
+		// source is an image, a host directory or "-" for a new
+		// filesystem, target directory and options are optional
+		dir, arg := "/", ""
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		if len(args) > 2 {
+			arg = args[2]
+		}
+		opts, mopts, err := parseOptions(arg)
 		if err != nil {
-			if !os.IsNotExist(err) {
+			return err
+		}
+
+		mopts.Source = args[0]
+		if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+			fs, err := osfs.New(args[0])
+			if err != nil {
 				return err
 			}
+			return b.vfs.Mount(dir, fs, mopts)
+		}
 
-			fs = memfs.Create()
-			if err := memfs.Save(args[0], fs); err != nil {
-				return err
+		var fs *memfs.MemFS
+		if args[0] == "-" {
+			fs = memfs.Create(opts)
+		} else if fs, err = memfs.Mount(args[0], opts); err != nil {
+			return err
+		}
+
+		if err := b.vfs.Mount(dir, fs, mopts); err != nil {
+			// drop the journal of the image that can't be attached
+			if args[0] != "-" {
+				fs.Unmount()
 			}
+			return err
+		}
+		return nil
+	})
+
+	b.Command("overlay", 1, func(args []string) error {
+		// lower layer is an image, upper one is a new filesystem
+		// made with the options
+		dir, arg := "/", ""
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		if len(args) > 2 {
+			arg = args[2]
+		}
+		opts, mopts, err := parseOptions(arg)
+		if err != nil {
+			return err
+		}
+
+		lower, err := memfs.Mount(args[0], opts)
+		if err != nil {
+			return err
+		}
+		mopts.Source = "overlay:" + args[0]
+		if err := b.vfs.Mount(dir, overlay.New(lower, memfs.Create(opts)), mopts); err != nil {
+			lower.Unmount()
+			return err
 		}
-		b.mounted = fs
-		b.fspath = args[0]
 		return nil
 	})
 
+	b.Command("commit", 0, func(args []string) error {
+		fs, _, err := b.vfs.Resolve(b.vfs.Pwd())
+		if err != nil {
+			return err
+		}
+		o, ok := fs.(*overlay.FS)
+		if !ok {
+			return fmt.Errorf("%s isn't an overlay", b.vfs.Pwd())
+		}
+		return o.Commit()
+	})
+
+	b.Command("watch", 1, func(args []string) error {
+		// -r watches the whole subtree of a directory,
+		// the watch lasts until the filesystem is unmounted
+		recursive := len(args) > 1 && args[1] == "-r"
+		fs, rel, err := b.memfs(args[0])
+		if err != nil {
+			return err
+		}
+		w, err := fs.Watch(rel, recursive, memfs.OpAll)
+		if err != nil {
+			return err
+		}
+		b.closers[fs] = append(b.closers[fs], w)
+
+		// events are reported with paths of the mount
+		name := args[0]
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(b.vfs.Pwd(), name)
+		}
+		mount := strings.TrimSuffix(filepath.Clean(name), rel)
+		go func() {
+			for e := range w.Events {
+				e.Path = filepath.Join(mount, e.Path)
+				if e.OldPath != "" {
+					e.OldPath = filepath.Join(mount, e.OldPath)
+				}
+				yellow.Println(e)
+			}
+		}()
+		return nil
+	})
+
+	b.Command("import", 1, func(args []string) error {
+		// source is a host directory or a tar archive,
+		// it is copied into the working directory by default
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		fs, rel, err := b.memfs(dir)
+		if err != nil {
+			return err
+		}
+		return fs.Import(args[0], rel)
+	})
+
+	b.Command("export", 1, func(args []string) error {
+		// destination ending with .tar, .tar.gz or .tgz is an archive,
+		// a host directory otherwise
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		fs, rel, err := b.memfs(dir)
+		if err != nil {
+			return err
+		}
+		return fs.Export(rel, args[0])
+	})
+
+	b.Command("webdav", 1, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+
+		l, err := net.Listen("tcp", args[0])
+		if err != nil {
+			return err
+		}
+		srv := dav.NewServer(fs)
+		b.closers[fs] = append(b.closers[fs], srv)
+		go srv.Serve(l)
+		fmt.Printf("serving WebDAV on http://%s/\n", l.Addr())
+		return nil
+	})
+
+	b.Command("mounts", 0, func(args []string) error {
+		for _, m := range b.vfs.Mounts() {
+			mode := "rw"
+			if m.Options.ReadOnly {
+				mode = "ro"
+			}
+			fmt.Printf("%s on %s (%s)\n", m.Options.Source, m.Path, mode)
+		}
+		return nil
+	})
+
+	b.Command("checkpoint", 0, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		return fs.Checkpoint()
+	})
+
+	b.Command("sync", 0, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		return fs.Sync()
+	})
+
+	b.Command("snapshot", 1, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		return fs.Snapshot(args[0])
+	})
+
+	b.Command("snapshots", 0, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		for _, name := range fs.Snapshots() {
+			fmt.Println(name)
+		}
+		return nil
+	})
+
+	b.Command("rollback", 1, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		return fs.Restore(args[0])
+	})
+
 	b.Command("close", 1, func(args []string) error {
 		fd, err := strconv.Atoi(args[0])
 		if err != nil {
 			return err
 		}
 
-		return b.mounted.Close(fd)
+		return b.vfs.Close(fd)
 	})
 
 	b.Command("read", 3, func(args []string) error {
@@ -125,7 +369,7 @@ func main() {
 			return err
 		}
 
-		data, err := b.mounted.Read(fd, off, size)
+		data, err := b.vfs.Read(fd, off, size)
 		if err != nil {
 			return err
 		}
@@ -148,7 +392,7 @@ func main() {
 		}
 
 		// todo: bug - not rewriting existing blocks
-		info, err := b.mounted.Write(fd, off, size, strings.Join(args[3:], " "))
+		info, err := b.vfs.Write(fd, off, size, strings.Join(args[3:], " "))
 		if err != nil {
 			return err
 		}
@@ -163,31 +407,116 @@ func main() {
 			return err
 		}
 
-		return b.mounted.Truncate(args[0], size)
+		return b.vfs.Truncate(args[0], size)
 	})
 
 	b.Command("rm", 1, func(args []string) error {
-		return b.mounted.Remove(args[0])
+		return b.vfs.Remove(args[0])
 	})
 
 	b.Command("rmdir", 1, func(args []string) error {
-		return b.mounted.RemoveDir(args[0])
+		return b.vfs.RemoveDir(args[0])
 	})
 
 	b.Command("link", 2, func(args []string) error {
-		return b.mounted.Link(args[0], args[1])
+		return b.vfs.Link(args[0], args[1])
 	})
 
 	b.Command("ln", 2, func(args []string) error {
-		return b.mounted.Ln(args[0], args[1])
+		return b.vfs.Symlink(args[0], args[1])
+	})
+
+	b.Command("mv", 2, func(args []string) error {
+		dst := args[1]
+		// moving into an existing directory keeps the name
+		if info, err := b.vfs.Lstat(dst); err == nil && info.IsDir() {
+			dst = filepath.Join(dst, filepath.Base(args[0]))
+		}
+		return b.vfs.Rename(args[0], dst)
+	})
+
+	b.Command("readlink", 1, func(args []string) error {
+		target, err := b.vfs.Readlink(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(target)
+		return nil
 	})
 
 	b.Command("unlink", 1, func(args []string) error {
-		return b.mounted.Unlink(args[0])
+		return b.vfs.Unlink(args[0])
+	})
+
+	b.Command("chmod", 2, func(args []string) error {
+		mode, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil {
+			return err
+		}
+
+		return b.vfs.Chmod(args[1], permMode(mode))
+	})
+
+	b.Command("chown", 2, func(args []string) error {
+		uid, gid, err := parseOwner(args[0])
+		if err != nil {
+			return err
+		}
+
+		return b.vfs.Chown(args[1], uid, gid)
+	})
+
+	b.Command("umask", 0, func(args []string) error {
+		fs, err := b.current()
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			fmt.Printf("%04o\n", uint32(fs.Umask()))
+			return nil
+		}
+
+		mask, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil {
+			return err
+		}
+		fs.SetUmask(os.FileMode(mask))
+		return nil
+	})
+
+	b.Command("su", 1, func(args []string) error {
+		uid, gid, err := parseOwner(args[0])
+		if err != nil {
+			return err
+		}
+
+		if gid == -1 {
+			gid = uid
+		}
+		// the user is the same in all mounts
+		for _, m := range b.vfs.Mounts() {
+			for _, fs := range layers(m.FS) {
+				fs.SetCred(memfs.Cred{Uid: uid, Gid: gid})
+			}
+		}
+		return nil
+	})
+
+	b.Command("df", 0, func(args []string) error {
+		for _, m := range b.vfs.Mounts() {
+			fs, ok := m.FS.(*memfs.MemFS)
+			if !ok {
+				continue
+			}
+			opts := fs.Options()
+			fmt.Printf("%s\n  block size: %d\n  used: %d\n  capacity: %d\n  inodes limit: %d\n",
+				m.Path, opts.BlockSize, fs.Used(), opts.Capacity, opts.MaxInodes)
+		}
+		return nil
 	})
 
 	b.Command("cat", 1, func(args []string) error {
-		data, err := b.mounted.Cat(args[0])
+		data, err := b.vfs.Cat(args[0])
 		if err != nil {
 			return err
 		}
@@ -197,3 +526,89 @@ func main() {
 
 	b.Run()
 }
+
+// layers returns MemFS layers of mounted fs
+func layers(fs vfs.Filesystem) []*memfs.MemFS {
+	switch fs := fs.(type) {
+	case *memfs.MemFS:
+		return []*memfs.MemFS{fs}
+	case *overlay.FS:
+		return []*memfs.MemFS{fs.Lower(), fs.Upper()}
+	}
+	return nil
+}
+
+// permMode converts octal chmod argument to os.FileMode
+func permMode(mode uint64) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// parseOptions parses comma separated mount options: ro, rw and
+// blocksize, capacity, maxinodes settings of a new filesystem like blocksize=512
+func parseOptions(arg string) (memfs.Options, vfs.MountOptions, error) {
+	var (
+		opts  memfs.Options
+		mopts vfs.MountOptions
+	)
+	if arg == "" {
+		return opts, mopts, nil
+	}
+
+	for _, opt := range strings.Split(arg, ",") {
+		switch opt {
+		case "ro":
+			mopts.ReadOnly = true
+			continue
+		case "rw":
+			mopts.ReadOnly = false
+			continue
+		}
+
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return opts, mopts, fmt.Errorf("unknown mount option %q", opt)
+		}
+		v, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return opts, mopts, err
+		}
+		switch parts[0] {
+		case "blocksize":
+			opts.BlockSize = int(v)
+		case "capacity":
+			opts.Capacity = v
+		case "maxinodes":
+			opts.MaxInodes = int(v)
+		default:
+			return opts, mopts, fmt.Errorf("unknown mount option %q", opt)
+		}
+	}
+	return opts, mopts, nil
+}
+
+// parseOwner parses "uid:gid" or "uid" argument, missing gid is -1
+func parseOwner(arg string) (int, int, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	gid := -1
+	if len(parts) > 1 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
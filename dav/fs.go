@@ -0,0 +1,230 @@
+package dav
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"fs/memfs"
+
+	"golang.org/x/net/webdav"
+)
+
+// FileSystem - webdav.FileSystem of a MemFS. Names are slash separated
+// and rooted at "/" of the MemFS whatever its working directory is,
+// every operation runs with the credential of the MemFS
+type FileSystem struct {
+	fs *memfs.MemFS
+}
+
+var (
+	_ webdav.FileSystem = (*FileSystem)(nil)
+	_ webdav.File       = (*file)(nil)
+	_ webdav.File       = (*dir)(nil)
+)
+
+// NewFileSystem creates webdav view of fs
+func NewFileSystem(fs *memfs.MemFS) *FileSystem {
+	return &FileSystem{fs: fs}
+}
+
+// clean makes name absolute and clean
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// iopath converts absolute path to the io/fs form
+func iopath(p string) string {
+	if p == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// Mkdir creates directory name, its parent must exist
+func (s *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = clean(name)
+	parent, err := s.fs.IOFS().Stat(iopath(path.Dir(name)))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: memfs.ErrNotDir}
+	}
+	if _, err := s.fs.Lstat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	if err := s.fs.Mkdir(name); err != nil {
+		return err
+	}
+	return s.fs.Chmod(name, perm&os.ModePerm&^s.fs.Umask())
+}
+
+// OpenFile opens file name with os.OpenFile style flags. Directories
+// can be opened for reading only, their entries are listed at open
+func (s *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = clean(name)
+	if info, err := s.fs.IOFS().Stat(iopath(name)); err == nil && info.IsDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: memfs.ErrIsDir}
+		}
+		entries, err := s.fs.IOFS().ReadDir(iopath(name))
+		if err != nil {
+			return nil, err
+		}
+		d := &dir{info: info, name: name}
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				d.entries = append(d.entries, info)
+			}
+		}
+		return d, nil
+	}
+
+	h, err := s.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{h}, nil
+}
+
+// RemoveAll removes name and everything it contains,
+// a missing name isn't an error. The root can't be removed
+func (s *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = clean(name)
+	if name == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrInvalid}
+	}
+	info, err := s.fs.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return s.remove(name, info)
+}
+
+// remove removes file or directory tree name described by info
+func (s *FileSystem) remove(name string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return s.fs.Unlink(name)
+	}
+
+	entries, err := s.fs.IOFS().ReadDir(iopath(name))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if err := s.remove(path.Join(name, e.Name()), info); err != nil {
+			return err
+		}
+	}
+	return s.fs.RemoveDir(name)
+}
+
+// Rename moves oldName to newName, the root can't be moved or replaced
+func (s *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	if oldName == "/" || newName == "/" {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	return s.fs.Rename(oldName, newName)
+}
+
+// Stat returns stats of name, symlinks are followed
+func (s *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return s.fs.IOFS().Stat(iopath(clean(name)))
+}
+
+// file - regular file open through the FileSystem
+type file struct {
+	*memfs.Handle
+}
+
+// Readdir - regular files have no entries
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: memfs.ErrNotDir}
+}
+
+// dir - directory open through the FileSystem, its entries are
+// listed at open and returned in order by Readdir
+type dir struct {
+	info    os.FileInfo
+	name    string
+	entries []os.FileInfo
+	off     int
+	closed  bool
+}
+
+func (d *dir) error(op string, err error) error {
+	return &os.PathError{Op: op, Path: d.name, Err: err}
+}
+
+// Stat returns directory stats
+func (d *dir) Stat() (os.FileInfo, error) {
+	if d.closed {
+		return nil, d.error("stat", os.ErrClosed)
+	}
+	return d.info, nil
+}
+
+// Readdir returns the next count entries, or all remaining if count <= 0
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.closed {
+		return nil, d.error("readdir", os.ErrClosed)
+	}
+
+	left := d.entries[d.off:]
+	if count <= 0 {
+		d.off = len(d.entries)
+		return left, nil
+	}
+	if len(left) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(left) {
+		count = len(left)
+	}
+	d.off += count
+	return left[:count], nil
+}
+
+// Seek can only rewind the listing
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	if d.closed {
+		return 0, d.error("seek", os.ErrClosed)
+	}
+	if offset != 0 || whence != io.SeekStart {
+		return 0, d.error("seek", syscall.EINVAL)
+	}
+	d.off = 0
+	return 0, nil
+}
+
+// Read - directories can't be read as a byte stream
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, d.error("read", memfs.ErrIsDir)
+}
+
+// Write - directories can't be written
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, d.error("write", memfs.ErrIsDir)
+}
+
+// Close the directory
+func (d *dir) Close() error {
+	if d.closed {
+		return d.error("close", os.ErrClosed)
+	}
+	d.closed = true
+	return nil
+}
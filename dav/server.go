@@ -0,0 +1,45 @@
+package dav
+
+import (
+	"net"
+	"net/http"
+
+	"fs/memfs"
+
+	"golang.org/x/net/webdav"
+)
+
+// Server - WebDAV server of a MemFS. Locks taken by clients are kept
+// in memory and shared by all listeners of the server
+type Server struct {
+	handler *webdav.Handler
+	http    *http.Server
+}
+
+// NewServer creates server of fs
+func NewServer(fs *memfs.MemFS) *Server {
+	s := &Server{
+		handler: &webdav.Handler{
+			FileSystem: NewFileSystem(fs),
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	s.http = &http.Server{Handler: s.handler}
+	return s
+}
+
+// ServeHTTP serves a WebDAV request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Serve accepts HTTP connections of l,
+// returns when l fails or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.http.Serve(l)
+}
+
+// Close stops all listeners and connections of the server
+func (s *Server) Close() error {
+	return s.http.Close()
+}
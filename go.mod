@@ -1,11 +1,17 @@
 module fs
 
-go 1.13
+go 1.20
 
 require (
 	github.com/fatih/color v1.7.0
-	github.com/jinzhu/copier v0.0.0-20190924061706-b57f9002281a // indirect
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.25.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-isatty v0.0.10 // indirect
-	github.com/pkg/errors v0.8.1
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,540 @@
+package memfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Import and export act with the credential of the filesystem, so they
+// may only make and read files it may. Like tar, import keeps owners and
+// setuid and setgid bits as recorded only for root, other callers own
+// the files they make. Trees are described by tar headers, both for
+// archives and host directories: names relative to the top directory,
+// hard links as TypeLink entries naming the first link
+
+// modeArchive - mode bits kept by import and export
+const modeArchive = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Import copies host directory or tar archive src into directory dir,
+// archives may be gzip compressed
+func (fs *MemFS) Import(src, dir string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fs.ImportDir(src, dir)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.ImportTar(f, dir)
+}
+
+// Export copies directory dir to a tar archive or a host directory dst.
+// Names ending with .tar are archives, .tar.gz and .tgz compressed ones
+func (fs *MemFS) Export(dir, dst string) error {
+	compress := strings.HasSuffix(dst, ".tar.gz") || strings.HasSuffix(dst, ".tgz")
+	if !compress && !strings.HasSuffix(dst, ".tar") {
+		return fs.ExportDir(dir, dst)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+
+	err = fs.ExportTar(w, dir)
+	if zw != nil {
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ImportTar extracts tar archive read from r into directory dir,
+// gzip compressed archive is detected. Entries are confined to dir,
+// devices and other special files are skipped
+func (fs *MemFS) ImportTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	im := newImporter(fs, dir)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return im.finish()
+		}
+		if err != nil {
+			return err
+		}
+		if err := im.put(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ImportDir copies host directory src into directory dir,
+// symlinks are copied as they are
+func (fs *MemFS) ImportDir(src, dir string) error {
+	// hard links are found among regular files of the same size
+	seen := make(map[int64][]string)
+	linked := func(host string, info os.FileInfo) string {
+		for _, other := range seen[info.Size()] {
+			if oi, err := os.Lstat(other); err == nil && os.SameFile(oi, info) {
+				return other
+			}
+		}
+		seen[info.Size()] = append(seen[info.Size()], host)
+		return ""
+	}
+
+	im := newImporter(fs, dir)
+	err := filepath.Walk(src, func(host string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var target string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(host); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		if hdr.Name, err = archiveName(src, host); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			if first := linked(host, info); first != "" {
+				hdr.Typeflag, hdr.Size = tar.TypeLink, 0
+				if hdr.Linkname, err = archiveName(src, first); err != nil {
+					return err
+				}
+				return im.put(hdr, nil)
+			}
+			f, err := os.Open(host)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return im.put(hdr, f)
+		}
+		return im.put(hdr, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return im.finish()
+}
+
+// archiveName makes tar name of host path inside top directory
+func archiveName(top, host string) (string, error) {
+	rel, err := filepath.Rel(top, host)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// importer - state of an import into directory dir. Modes and times of
+// directories are set after all entries are made, making them changes the
+// times and a read-only mode would keep the entries from being made.
+// root is a view acting as root, set only if fs acts as root already
+type importer struct {
+	fs   *MemFS
+	root *MemFS
+	dir  string
+	dirs []*tar.Header
+}
+
+// newImporter starts import into directory dir of fs
+func newImporter(fs *MemFS, dir string) *importer {
+	im := &importer{fs: fs, dir: filepath.Clean(dir)}
+	if fs.Cred().Uid == 0 {
+		im.root = fs.WithCred(Cred{}, 0)
+	}
+	return im
+}
+
+// path maps archive name to a path inside the import directory
+func (im *importer) path(name string) string {
+	return filepath.Join(im.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// put makes file described by hdr, reading data of regular files from r.
+// Existing files are replaced, existing directories are kept
+func (im *importer) put(hdr *tar.Header, r io.Reader) error {
+	fs := im.fs
+	name := im.path(hdr.Name)
+	if err := im.confined(name); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		if err := im.confined(im.path(hdr.Linkname)); err != nil {
+			return err
+		}
+	}
+
+	old, err := fs.Lstat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if old != nil && !(old.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := im.remove(name, old); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if _, err := fs.Lstat(filepath.Dir(name)); os.IsNotExist(err) {
+			if err := fs.Mkdir(filepath.Dir(name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if old == nil {
+			if err := fs.Mkdir(name); err != nil {
+				return err
+			}
+		}
+		// only root changes attributes of directories it didn't make
+		if old == nil || im.root != nil {
+			im.dirs = append(im.dirs, hdr)
+		}
+		return im.chown(name, hdr)
+	case tar.TypeReg, tar.TypeRegA:
+		h, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(h, r); err != nil {
+			h.Close()
+			return err
+		}
+		if err := h.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := fs.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+		return im.chown(name, hdr)
+	case tar.TypeLink:
+		// attributes belong to the file linked
+		return fs.Link(im.path(hdr.Linkname), name)
+	default:
+		return nil
+	}
+
+	if err := im.chown(name, hdr); err != nil {
+		return err
+	}
+	if err := im.chmod(name, hdr); err != nil {
+		return err
+	}
+	return fs.Chtimes(name, accessTime(hdr), hdr.ModTime)
+}
+
+// chown gives name the owner of entry hdr when importing as root,
+// otherwise the file stays owned by the caller
+func (im *importer) chown(name string, hdr *tar.Header) error {
+	if im.root == nil {
+		return nil
+	}
+	return im.root.Lchown(name, hdr.Uid, hdr.Gid)
+}
+
+// chmod sets mode of entry hdr to name, setuid and setgid bits
+// are kept only when importing as root
+func (im *importer) chmod(name string, hdr *tar.Header) error {
+	mode := hdr.FileInfo().Mode() & modeArchive
+	if im.root == nil {
+		return im.fs.Chmod(name, mode&^(os.ModeSetuid|os.ModeSetgid))
+	}
+	return im.root.Chmod(name, mode)
+}
+
+// confined checks that no directory between the import directory
+// and name is a symlink, which could lead the entry out of it
+func (im *importer) confined(name string) error {
+	for dir := filepath.Dir(name); dir != im.dir && strings.HasPrefix(dir, im.dir); dir = filepath.Dir(dir) {
+		info, err := im.fs.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return &os.PathError{Op: "import", Path: name, Err: fmt.Errorf("%q is a symlink", dir)}
+		}
+	}
+	return nil
+}
+
+// remove removes file name replaced by an archive entry
+func (im *importer) remove(name string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return im.fs.Remove(name)
+	}
+	entries, err := im.fs.IOFS().ReadDir(iopath(name))
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		child := filepath.Join(name, d.Name())
+		ci, err := im.fs.Lstat(child)
+		if err != nil {
+			return err
+		}
+		if err := im.remove(child, ci); err != nil {
+			return err
+		}
+	}
+	return im.fs.RemoveDir(name)
+}
+
+// finish sets modes and times of imported directories, deepest first
+func (im *importer) finish() error {
+	for i := len(im.dirs) - 1; i >= 0; i-- {
+		hdr := im.dirs[i]
+		name := im.path(hdr.Name)
+		if err := im.chmod(name, hdr); err != nil {
+			return err
+		}
+		if err := im.fs.Chtimes(name, accessTime(hdr), hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accessTime of the entry, archives without one use modification time
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// iopath converts absolute path to the io/fs form
+func iopath(name string) string {
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// ExportTar writes directory dir as tar archive to w
+func (fs *MemFS) ExportTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := fs.walkArchive(filepath.Clean(dir), func(hdr *tar.Header, name string) error {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		return fs.copyOut(tw, name)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExportDir copies directory dir to host directory dst, which is made
+// if it doesn't exist. Owners are kept only if the process may change them
+func (fs *MemFS) ExportDir(dir, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	var dirs []*tar.Header
+	err := fs.walkArchive(filepath.Clean(dir), func(hdr *tar.Header, name string) error {
+		host := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+		return fs.exportEntry(hdr, name, host, dst)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+		host := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if err := os.Chtimes(host, accessTime(hdr), hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportEntry makes host file of entry hdr of file name,
+// existing host file other than a directory is replaced
+func (fs *MemFS) exportEntry(hdr *tar.Header, name, host, dst string) error {
+	if old, err := os.Lstat(host); err == nil && !(old.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(host); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode() & modeArchive
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(host, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(host, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if err := fs.copyOut(f, name); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, host); err != nil {
+			return err
+		}
+		os.Lchown(host, hdr.Uid, hdr.Gid)
+		return nil
+	case tar.TypeLink:
+		return os.Link(filepath.Join(dst, filepath.FromSlash(hdr.Linkname)), host)
+	}
+
+	// owners are kept only if the process may change them
+	os.Lchown(host, hdr.Uid, hdr.Gid)
+	if err := os.Chmod(host, mode); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return os.Chtimes(host, accessTime(hdr), hdr.ModTime)
+}
+
+// copyOut writes data of regular file name to w
+func (fs *MemFS) copyOut(w io.Writer, name string) error {
+	h, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	_, err = io.Copy(w, h)
+	return err
+}
+
+// walkArchive calls fn with tar header and path of dir and each file
+// below it, parents come before their entries
+func (fs *MemFS) walkArchive(dir string, fn func(hdr *tar.Header, name string) error) error {
+	links := make(map[uint64]string)
+
+	var walk func(name, rel string) error
+	walk = func(name, rel string) error {
+		info, err := fs.Lstat(name)
+		if err != nil {
+			return err
+		}
+		hdr, err := fs.header(info, name, rel, links)
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, name); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		entries, err := fs.IOFS().ReadDir(iopath(name))
+		if err != nil {
+			return err
+		}
+		for _, d := range entries {
+			if err := walk(filepath.Join(name, d.Name()), path.Join(rel, d.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(dir, ".")
+}
+
+// header describes file name at archive name rel, links maps inodes
+// with more links to the archive name of the first one
+func (fs *MemFS) header(info os.FileInfo, name, rel string, links map[uint64]string) (*tar.Header, error) {
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if target, err = fs.Readlink(name); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// PAX keeps access time and sub-second times
+	hdr.Format = tar.FormatPAX
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if fi, ok := info.(*fileInfo); ok {
+		hdr.Uid, hdr.Gid = fi.uid, fi.gid
+		hdr.AccessTime, hdr.ChangeTime = fi.atime, fi.ctime
+		if fi.nlink > 1 && !info.IsDir() {
+			if first, ok := links[fi.ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[fi.ino] = rel
+			}
+		}
+	}
+	return hdr, nil
+}
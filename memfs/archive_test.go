@@ -0,0 +1,146 @@
+package memfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"fs/memfs"
+)
+
+// TestArchiveKeepsCred exports and imports archives with an unprivileged
+// credential while the same filesystem is used with it, which must never
+// gain root access. It is meant to be run with -race
+func TestArchiveKeepsCred(t *testing.T) {
+	src := memfs.Create()
+	populate(t, src)
+	var archive bytes.Buffer
+	if err := src.ExportTar(&archive, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := memfs.Create()
+	if err := fs.Mkdir("/in"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/in", 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	user := memfs.Cred{Uid: 1000, Gid: 1000}
+	fs.SetCred(user)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for r := 0; r < 20; r++ {
+				dir := fmt.Sprintf("/in/%d-%d", i, r)
+				if err := fs.ImportTar(bytes.NewReader(archive.Bytes()), dir); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := fs.ExportTar(&bytes.Buffer{}, dir); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for checking := true; checking; {
+		select {
+		case <-done:
+			checking = false
+		default:
+		}
+		if c := fs.Cred(); c.Uid != user.Uid {
+			t.Fatalf("credential changed to %+v", c)
+		}
+		if err := fs.Create("/escalated"); !os.IsPermission(err) {
+			t.Fatalf("create in root: %v, want permission error", err)
+		}
+	}
+
+	if data, err := fs.Cat("/in/0-0/a/b/c/three"); err != nil || data != "333" {
+		t.Errorf("imported file: %q, %v", data, err)
+	}
+}
+
+func TestArchivePermissions(t *testing.T) {
+	src := memfs.Create()
+	populate(t, src)
+	// chown clears setuid and setgid bits, so it goes first
+	if err := src.Chown("/a/one", 5, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Chmod("/a/one", 0755|os.ModeSetuid|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := src.ExportTar(&archive, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := memfs.Create()
+	for _, dir := range []string{"/in", "/home", "/priv"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Chown("/home", 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/priv/secret", "secret")
+	if err := fs.Chmod("/priv/secret", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/priv/secret", 2000, 2000); err != nil {
+		t.Fatal(err)
+	}
+	user := fs.WithCred(memfs.Cred{Uid: 1000, Gid: 1000}, 022)
+
+	// access checks apply to the caller
+	if err := user.ImportTar(bytes.NewReader(archive.Bytes()), "/in"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("import into root-owned directory: %v, want permission error", err)
+	}
+	if err := user.ExportTar(&bytes.Buffer{}, "/priv"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("export of unreadable file: %v, want permission error", err)
+	}
+
+	// owners and setuid and setgid bits are kept only by root
+	if err := user.ImportTar(bytes.NewReader(archive.Bytes()), "/home/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ImportTar(bytes.NewReader(archive.Bytes()), "/in"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		uid  int
+		mode os.FileMode
+	}{
+		{"/home/x/a/one", 1000, 0755},
+		{"/in/a/one", 5, 0755 | os.ModeSetuid | os.ModeSetgid},
+	} {
+		info, err := fs.Lstat(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid := info.(interface{ Uid() int }).Uid()
+		if uid != tt.uid || info.Mode() != tt.mode {
+			t.Errorf("%s: uid %d, mode %v, want %d, %v", tt.name, uid, info.Mode(), tt.uid, tt.mode)
+		}
+	}
+	if data, err := user.Cat("/home/x/a/b/c/three"); err != nil || data != "333" {
+		t.Errorf("imported file: %q, %v", data, err)
+	}
+}
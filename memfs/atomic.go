@@ -0,0 +1,103 @@
+package memfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SaveOptions - how Save replaces the file
+type SaveOptions struct {
+	// Backups - count of previous versions kept as path.1, path.2 and so on,
+	// path.1 is the newest
+	Backups int
+}
+
+// writeFile replaces the file at path with the data produced by write.
+// Data goes to a temp file in the same directory which is synced and renamed
+// over path, so a crash leaves either the old or the new file in place
+func writeFile(path string, backups int, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = write(f); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = rotate(path, backups); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotate shifts backups of path by one and makes the current file path.1.
+// The current file is hard linked, so path exists until it is replaced
+func rotate(path string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := backups; i > 1; i-- {
+		err := os.Rename(backup(path, i-1), backup(path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	first := backup(path, 1)
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(path, first)
+}
+
+// backup - name of i-th backup of path
+func backup(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// syncDir flushes directory entries, so renames in dir survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
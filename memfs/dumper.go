@@ -1,13 +1,43 @@
 package memfs
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
+// iproto - inode representation for saving
+type iproto struct {
+	Ino     uint64
+	Dir     bool
+	Mode    os.FileMode
+	Uid     int
+	Gid     int
+	Nlink   int
+	Size    int64
+	ModTime time.Time
+	ATime   time.Time
+	CTime   time.Time
+	BTime   time.Time
+	Entries map[string]uint64 `json:",omitempty"`
+	Parent  uint64
+	Link    string   `json:",omitempty"`
+	Data    string   `json:",omitempty"`
+	Extents []xproto `json:",omitempty"`
+}
+
+// xproto - run of allocated data blocks, holes between runs aren't saved
+type xproto struct {
+	Off  int64
+	Data string
+}
+
+// fproto - file tree representation used by dumps before the inode table
 type fproto struct {
 	ID      uint64
 	Name    string
@@ -21,72 +51,187 @@ type fproto struct {
 }
 
 type fsproto struct {
-	Table   map[uint64]string
-	Volumes fproto
-	Size    uint64
+	Inodes    []iproto `json:",omitempty"`
+	Volumes   *fproto  `json:",omitempty"`
+	Size      uint64
+	BlockSize int   `json:",omitempty"`
+	Capacity  int64 `json:",omitempty"`
+	MaxInodes int   `json:",omitempty"`
 }
 
-func fileToProto(f *File) fproto {
-	var childs = make(map[string]fproto)
-	if f.IsDir() && len(f.childs) > 0 {
-		for name, f := range f.childs {
-			childs[name] = fileToProto(f)
+// inodeToProto copies n for saving, caller holds the tree lock but not n lock
+func inodeToProto(n *inode) iproto {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var entries map[string]uint64
+	if n.entries != nil {
+		entries = make(map[string]uint64, len(n.entries))
+		for name, ino := range n.entries {
+			entries[name] = ino
 		}
 	}
 
-	var parent string
-	if f.parent != nil {
-		parent = f.parent.AbsPath()
+	return iproto{
+		Ino:     n.ino,
+		Dir:     n.dir,
+		Mode:    n.mode,
+		Uid:     n.uid,
+		Gid:     n.gid,
+		Nlink:   n.nlink,
+		Size:    n.size,
+		ModTime: n.mtime,
+		ATime:   n.atime,
+		CTime:   n.ctime,
+		BTime:   n.btime,
+		Entries: entries,
+		Parent:  n.dotdot,
+		Link:    n.target,
+		Extents: extents(n),
 	}
+}
 
-	return fproto{
-		ID:      f.id,
-		Name:    f.name,
-		Dir:     f.dir,
-		Parent:  parent,
-		Size:    f.size,
-		ModTime: f.modtime,
-		Childs:  childs,
-		Links:   f.links,
-		Data:    string(f.Read()),
-	}
+// extents collects runs of consecutive allocated blocks of n
+func extents(n *inode) []xproto {
+	var runs []xproto
+	n.data.ascend(0, func(e *extent) bool {
+		end := e.end()
+		if end > n.size {
+			end = n.size
+		}
+		if e.off >= end {
+			return false
+		}
+
+		data := string(e.data[:end-e.off])
+		// adjacent extents make one run
+		if last := len(runs) - 1; last >= 0 && runs[last].Off+int64(len(runs[last].Data)) == e.off {
+			runs[last].Data += data
+		} else {
+			runs = append(runs, xproto{Off: e.off, Data: data})
+		}
+		return true
+	})
+	return runs
 }
 
-func fileFromProto(fs *MemFS, p *fproto) *File {
-	f := &File{
-		id:      p.ID,
-		name:    p.Name,
+func inodeFromProto(p *iproto, blksize int) *inode {
+	n := &inode{
+		ino:     p.Ino,
 		dir:     p.Dir,
-		size:    p.Size,
-		modtime: p.ModTime,
-		links:   p.Links,
+		mode:    p.Mode,
+		uid:     p.Uid,
+		gid:     p.Gid,
+		nlink:   p.Nlink,
+		blksize: blksize,
+		mtime:   p.ModTime,
+		atime:   p.ATime,
+		ctime:   p.CTime,
+		btime:   p.BTime,
+		dotdot:  p.Parent,
+		target:  p.Link,
+	}
+
+	if n.ctime.IsZero() {
+		// dumps made before all timestamps were kept
+		n.atime, n.ctime, n.btime = n.mtime, n.mtime, n.mtime
 	}
 
-	if f.dir && len(p.Childs) > 0 {
-		f.childs = make(map[string]*File)
-		for name, file := range p.Childs {
-			f.childs[name] = fileFromProto(fs, &file)
-			f.childs[name].parent = f
+	if n.dir {
+		n.entries = p.Entries
+		if n.entries == nil {
+			n.entries = make(map[string]uint64)
 		}
 	}
 
-	f.Write([]byte(p.Data))
-	f.fs = fs
-	return f
+	// dumps made before sparse files keep whole data in one string
+	data := p.Data
+	if p.Size == 0 {
+		data = unpad(data)
+	}
+	n.WriteAt([]byte(data), 0)
+	for _, x := range p.Extents {
+		n.WriteAt([]byte(x.Data), int(x.Off))
+	}
+	if p.Size > n.size {
+		n.size = p.Size
+	}
+	return n
+}
+
+// unpad strips NUL padding of the last block from data of dumps
+// made before the exact file size was kept
+func unpad(data string) string {
+	for i := 0; i < DefaultBlockSize-1 && strings.HasSuffix(data, "\x00"); i++ {
+		data = data[:len(data)-1]
+	}
+	return data
+}
+
+// legacy converts file tree of an old dump into inodes
+func (fs *MemFS) legacy(parent *inode, name string, p *fproto) {
+	n := &inode{
+		ino:     p.ID,
+		dir:     p.Dir,
+		blksize: fs.blksize,
+	}
+	n.mode = 0666 &^ defaultUmask
+	switch {
+	case n.dir:
+		n.mode = 0777 &^ defaultUmask
+		n.entries = make(map[string]uint64)
+	case strings.HasPrefix(p.Data, "sym:"):
+		// old dumps keep symlinks as files with "sym:" prefixed target
+		n.mode = os.ModeSymlink | os.ModePerm
+		n.target = strings.TrimPrefix(p.Data, "sym:")
+	default:
+		n.WriteAt([]byte(unpad(p.Data)), 0)
+	}
+	fs.inodes.set(n.ino, n)
+
+	if parent == nil {
+		n.nlink = 2
+		fs.root = n
+	} else {
+		fs.link(parent, name, n)
+	}
+
+	for name, child := range p.Childs {
+		fs.legacy(n, name, &child)
+	}
+
+	// linking touched the times, old dumps have only modification time
+	n.atime, n.mtime, n.ctime, n.btime = p.ModTime, p.ModTime, p.ModTime, p.ModTime
 }
 
 // MarshalJSON for saving
 func (f *File) MarshalJSON() ([]byte, error) {
-	proto := fileToProto(f)
+	f.fs.mu.RLock()
+	proto := inodeToProto(f.inode)
+	f.fs.mu.RUnlock()
 	return json.Marshal(proto)
 }
 
 // MarshalJSON for saving
 func (fs *MemFS) MarshalJSON() ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	inodes := make([]iproto, 0, fs.inodes.len())
+	fs.inodes.ascend(func(n *inode) bool {
+		// skip unlinked inodes kept alive by open handles
+		if n.nlink > 0 {
+			inodes = append(inodes, inodeToProto(n))
+		}
+		return true
+	})
+
 	return json.Marshal(&fsproto{
-		Size:    fs.ids,
-		Table:   fs.table,
-		Volumes: fileToProto(fs.root),
+		Size:      fs.ids,
+		Inodes:    inodes,
+		BlockSize: fs.blksize,
+		Capacity:  fs.capacity,
+		MaxInodes: fs.maxInodes,
 	})
 }
 
@@ -96,12 +241,47 @@ func (fs *MemFS) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, proto); err != nil {
 		return err
 	}
+	if fs.tree == nil {
+		fs.tree = &tree{}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
 	fs.ids = proto.Size
-	fs.table = proto.Table
-	fs.root = fileFromProto(fs, &proto.Volumes)
+	fs.blksize = proto.BlockSize
+	if fs.blksize <= 0 {
+		// dumps made before the block size was configurable
+		fs.blksize = DefaultBlockSize
+	}
+	fs.capacity = proto.Capacity
+	fs.maxInodes = proto.MaxInodes
+
+	// snapshots aren't kept in dumps
+	fs.inodes = itable{}
+	fs.snapshots, fs.gen = nil, 0
+	if proto.Volumes != nil {
+		fs.legacy(nil, "/", proto.Volumes)
+	} else {
+		for i := range proto.Inodes {
+			n := inodeFromProto(&proto.Inodes[i], fs.blksize)
+			fs.inodes.set(n.ino, n)
+		}
+		fs.root = fs.inodes.get(0)
+	}
+	if fs.root == nil || !fs.root.dir {
+		return fmt.Errorf("dump has no root directory")
+	}
+
+	fs.used = 0
+	fs.inodes.ascend(func(n *inode) bool {
+		fs.used += n.data.size
+		return true
+	})
+
 	fs.wd = fs.root
-	fs.opened = make(map[int]*File)
+	fs.opened = fdTable{}
+	fs.umask = defaultUmask
 	return nil
 }
 
@@ -114,36 +294,63 @@ var Marshal = func(v interface{}) (io.Reader, error) {
 	return bytes.NewReader(b), nil
 }
 
-// Save saves a representation of v to the file at path
-func Save(path string, v interface{}) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
+// Save saves a representation of v to the file at path,
+// MemFS is saved as binary image. The file is replaced atomically,
+// on error the previous version is left intact
+func Save(path string, v interface{}, opts ...SaveOptions) error {
+	var o SaveOptions
+	if len(opts) > 0 {
+		o = opts[0]
 	}
-	defer f.Close()
 
-	r, err := Marshal(v)
-	if err != nil {
-		return err
-	}
+	return writeFile(path, o.Backups, func(w io.Writer) error {
+		if fs, ok := v.(*MemFS); ok {
+			_, err := fs.WriteTo(w)
+			return err
+		}
 
-	_, err = io.Copy(f, r)
-	return err
+		r, err := Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		return err
+	})
 }
 
-// Load loads the file at path into
+// Load loads the file at path into a new MemFS,
+// binary images and JSON dumps are both accepted.
+// Committed changes of the journal next to the image are replayed
 func Load(path string) (*MemFS, error) {
+	fs, _, err := load(path)
+	return fs, err
+}
+
+// load loads the image and returns length of its intact journal
+func load(path string) (*MemFS, int64, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer f.Close()
 
-	fs := &MemFS{}
-	err = json.NewDecoder(f).Decode(fs)
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(imageMagic))
+
+	fs := &MemFS{tree: &tree{}}
+	if isImage(magic) {
+		_, err = fs.ReadFrom(r)
+	} else {
+		err = json.NewDecoder(r).Decode(fs)
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return fs, nil
+	valid, err := fs.replay(journalPath(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	return fs, valid, nil
 }
@@ -0,0 +1,184 @@
+package memfs
+
+// extent - run of allocated file data starting at logical offset off.
+// Offset and length of data are multiples of the file block size.
+// gen is generation of the inode the extent was made in, extents of
+// older generations are shared with snapshots and are never changed
+type extent struct {
+	off  int64
+	data []byte
+	gen  uint64
+}
+
+// end - offset just past the extent
+func (e *extent) end() int64 {
+	return e.off + int64(len(e.data))
+}
+
+// extentTree - extents of a file ordered by offset. It is a treap,
+// so lookups and updates take O(log n) for n extents. Zero value is empty
+type extentTree struct {
+	root *enode
+	// allocated bytes of all extents
+	size int64
+}
+
+// enode - node of the extent tree
+type enode struct {
+	e           *extent
+	prio        uint64
+	left, right *enode
+}
+
+// priority derives pseudo random treap priority from offset
+func priority(off int64) uint64 {
+	// splitmix64 finalizer
+	x := uint64(off) + 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// split divides t into extents with offset below off and the rest
+func split(t *enode, off int64) (*enode, *enode) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.e.off < off {
+		l, r := split(t.right, off)
+		t.right = l
+		return t, r
+	}
+	l, r := split(t.left, off)
+	t.left = r
+	return l, t
+}
+
+// merge joins trees where all offsets of l are below offsets of r
+func merge(l, r *enode) *enode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.prio > r.prio {
+		l.right = merge(l.right, r)
+		return l
+	}
+	r.left = merge(l, r.left)
+	return r
+}
+
+// insert adds e, no other extent may start at its offset
+func (t *extentTree) insert(e *extent) {
+	l, r := split(t.root, e.off)
+	t.root = merge(merge(l, &enode{e: e, prio: priority(e.off)}), r)
+	t.size += int64(len(e.data))
+}
+
+// remove deletes extent e
+func (t *extentTree) remove(e *extent) {
+	l, r := split(t.root, e.off)
+	_, r = split(r, e.off+1)
+	t.root = merge(l, r)
+	t.size -= int64(len(e.data))
+}
+
+// resize replaces data of extent e keeping its offset
+func (t *extentTree) resize(e *extent, data []byte) {
+	t.size += int64(len(data) - len(e.data))
+	e.data = data
+}
+
+// floor finds extent with the greatest offset not above off
+func (t *extentTree) floor(off int64) *extent {
+	var found *extent
+	for node := t.root; node != nil; {
+		if node.e.off <= off {
+			found = node.e
+			node = node.right
+		} else {
+			node = node.left
+		}
+	}
+	return found
+}
+
+// ceil finds extent with the least offset not below off
+func (t *extentTree) ceil(off int64) *extent {
+	var found *extent
+	for node := t.root; node != nil; {
+		if node.e.off >= off {
+			found = node.e
+			node = node.left
+		} else {
+			node = node.right
+		}
+	}
+	return found
+}
+
+// ascend calls fn for extents ending after off in offset order until fn returns false
+func (t *extentTree) ascend(off int64, fn func(e *extent) bool) {
+	var walk func(node *enode) bool
+	walk = func(node *enode) bool {
+		if node == nil {
+			return true
+		}
+		// extents don't overlap, left ones end before this one starts
+		if node.e.end() > off {
+			if !walk(node.left) || !fn(node.e) {
+				return false
+			}
+		}
+		return walk(node.right)
+	}
+	walk(t.root)
+}
+
+// maxRun - extents aren't extended past this size, so growing
+// one doesn't copy much and its spare capacity stays small
+const maxRun = 1 << 20
+
+// extend appends size zero bytes to data, capacity is doubled
+// when it runs out so appending runs cost amortized O(size)
+func extend(data []byte, size int) []byte {
+	if cap(data)-len(data) >= size {
+		// spare capacity is never written, it is zero
+		return data[:len(data)+size]
+	}
+
+	length := len(data) + size
+	capacity := 2 * length
+	if capacity > maxRun {
+		capacity = maxRun
+	}
+	if capacity < length {
+		capacity = length
+	}
+
+	grown := make([]byte, length, capacity)
+	copy(grown, data)
+	return grown
+}
+
+// clone copies the tree, extents are shared with the copy
+func (t *extentTree) clone() extentTree {
+	var walk func(node *enode) *enode
+	walk = func(node *enode) *enode {
+		if node == nil {
+			return nil
+		}
+		return &enode{e: node.e, prio: node.prio, left: walk(node.left), right: walk(node.right)}
+	}
+	return extentTree{root: walk(t.root), size: t.size}
+}
+
+// extentAt finds extent holding byte at off
+func (t *extentTree) extentAt(off int64) *extent {
+	if e := t.floor(off); e != nil && off < e.end() {
+		return e
+	}
+	return nil
+}
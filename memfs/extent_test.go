@@ -0,0 +1,168 @@
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// block - fixed size data block of the layout extents replaced
+type block struct {
+	data []byte
+}
+
+// blockFile - file data stored as a slice of blocks, the layout used before
+// extents. It is kept as the baseline of benchmarks: WriteAt walks the slice
+// from the first block and ReadAt copies all data from the offset to the end
+// of the file before taking the requested bytes
+type blockFile struct {
+	blksize int
+	size    int
+	data    []*block
+}
+
+// WriteAt writes p at off, blocks up to off are allocated
+func (f *blockFile) WriteAt(p []byte, off int) (int, error) {
+	end := off + len(p)
+	for len(f.data)*f.blksize < end {
+		f.data = append(f.data, &block{data: make([]byte, f.blksize)})
+	}
+
+	pos := 0
+	for _, b := range f.data {
+		if pos+f.blksize > off && pos < end {
+			from := off - pos
+			if from < 0 {
+				from = 0
+			}
+			to := end - pos
+			if to > f.blksize {
+				to = f.blksize
+			}
+			copy(b.data[from:to], p[pos+from-off:])
+		}
+		pos += f.blksize
+	}
+	if end > f.size {
+		f.size = end
+	}
+	return len(p), nil
+}
+
+// ReadAt reads data at off into p
+func (f *blockFile) ReadAt(p []byte, off int) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	var buf bytes.Buffer
+	for i := off / f.blksize; i < len(f.data); i++ {
+		buf.Write(f.data[i].data)
+	}
+	data := buf.Bytes()[off%f.blksize:]
+	if len(data) > f.size-off {
+		data = data[:f.size-off]
+	}
+
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileData - operations both layouts implement
+type fileData interface {
+	WriteAt(p []byte, off int) (int, error)
+	ReadAt(p []byte, off int) (int, error)
+}
+
+const (
+	benchBlock = 4096
+	benchSize  = 4 << 20
+	benchIO    = 4096
+)
+
+var layouts = []struct {
+	name string
+	open func() fileData
+}{
+	{"blocks", func() fileData { return &blockFile{blksize: benchBlock} }},
+	{"extents", func() fileData { return &inode{blksize: benchBlock} }},
+}
+
+// filled returns file data of benchSize bytes in the layout
+func filled(open func() fileData) fileData {
+	f := open()
+	chunk := bytes.Repeat([]byte{'x'}, 64<<10)
+	for off := 0; off < benchSize; off += len(chunk) {
+		f.WriteAt(chunk, off)
+	}
+	return f
+}
+
+func TestLayoutsMatch(t *testing.T) {
+	blocks, extents := &blockFile{blksize: 16}, &inode{blksize: 16}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		p := make([]byte, rnd.Intn(100))
+		rnd.Read(p)
+		off := rnd.Intn(4096)
+		blocks.WriteAt(p, off)
+		extents.WriteAt(p, off)
+
+		off, size := rnd.Intn(4200), rnd.Intn(200)
+		want, got := make([]byte, size), make([]byte, size)
+		wn, werr := blocks.ReadAt(want, off)
+		gn, gerr := extents.ReadAt(got, off)
+		if wn != gn || werr != gerr || !bytes.Equal(want[:wn], got[:gn]) {
+			t.Fatalf("read %d bytes at %d: extents %d, %v, blocks %d, %v", size, off, gn, gerr, wn, werr)
+		}
+	}
+}
+
+func BenchmarkReadAt(b *testing.B) {
+	for _, l := range layouts {
+		b.Run(l.name, func(b *testing.B) {
+			f := filled(l.open)
+			p := make([]byte, benchIO)
+			rnd := rand.New(rand.NewSource(1))
+			b.SetBytes(benchIO)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.ReadAt(p, rnd.Intn(benchSize-benchIO))
+			}
+		})
+	}
+}
+
+func BenchmarkWriteAt(b *testing.B) {
+	for _, l := range layouts {
+		b.Run(l.name, func(b *testing.B) {
+			f := filled(l.open)
+			p := bytes.Repeat([]byte{'y'}, benchIO)
+			rnd := rand.New(rand.NewSource(1))
+			b.SetBytes(benchIO)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.WriteAt(p, rnd.Intn(benchSize-benchIO))
+			}
+		})
+	}
+}
+
+func BenchmarkSequentialWrite(b *testing.B) {
+	for _, l := range layouts {
+		b.Run(l.name, func(b *testing.B) {
+			p := bytes.Repeat([]byte{'z'}, 64<<10)
+			b.SetBytes(benchSize)
+			for i := 0; i < b.N; i++ {
+				f := l.open()
+				for off := 0; off < benchSize; off += len(p) {
+					f.WriteAt(p, off)
+				}
+			}
+		})
+	}
+}
@@ -1,28 +1,20 @@
 package memfs
 
 import (
-	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
-
-	vfs "fs"
 )
 
-// File in-memory representation
+// File - named link to an inode.
+// Its methods lock the filesystem, inode methods expect caller to hold the locks
 type File struct {
-	id      uint64
-	name    string
-	dir     bool
-	mode    os.FileMode
-	parent  *File
-	linked  string
-	size    int64
-	modtime time.Time
-	fs      vfs.Filesystem
-	childs  map[string]*File
-	links   []string
-	data    []*Block
+	*inode
+	name   string
+	parent *inode
+	fs     *MemFS
 }
 
 // Sys returns underlying data source
@@ -30,182 +22,423 @@ func (f *File) Sys() interface{} {
 	return f.fs
 }
 
-// IsDir - check if dir
-func (f *File) IsDir() bool {
-	return f.dir
+// Name of the file
+func (f *File) Name() string {
+	return f.name
 }
 
-// ModTime returns last modification time
-func (f *File) ModTime() time.Time {
-	return f.modtime
+// AbsPath - absolute path to file
+func (f *File) AbsPath() string {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.parent != nil {
+		return filepath.Join(f.fs.path(f.parent), f.name)
+	}
+	return "/"
+}
+
+// stat takes snapshot of the file stats
+func (f *File) stat() *fileInfo {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.fs.info(f.name, f.inode)
 }
 
 // Mode - to implemet interface
 func (f *File) Mode() os.FileMode {
-	return f.mode
+	return f.stat().Mode()
 }
 
-// Name of the file
-func (f *File) Name() string {
-	return f.name
+// ModTime returns last modification time
+func (f *File) ModTime() time.Time {
+	return f.stat().ModTime()
 }
 
-// ID of the file
-func (f *File) ID() uint64 {
-	return f.id
+// Size in bytes
+func (f *File) Size() int64 {
+	return f.stat().Size()
 }
 
-// AbsPath - absolute path to file
-func (f *File) AbsPath() string {
-	if f.parent != nil {
-		return filepath.Join(f.parent.AbsPath(), f.name)
-	}
-	return "/"
+// Nlink - number of hard links to the file
+func (f *File) Nlink() int {
+	return f.stat().Nlink()
+}
+
+// Uid - owner of the file
+func (f *File) Uid() int {
+	return f.stat().Uid()
+}
+
+// Gid - group of the file
+func (f *File) Gid() int {
+	return f.stat().Gid()
+}
+
+// AccessTime returns last access time
+func (f *File) AccessTime() time.Time {
+	return f.stat().AccessTime()
+}
+
+// ChangeTime returns last metadata change time
+func (f *File) ChangeTime() time.Time {
+	return f.stat().ChangeTime()
+}
+
+// BirthTime returns creation time
+func (f *File) BirthTime() time.Time {
+	return f.stat().BirthTime()
+}
+
+// Blocks count
+func (f *File) Blocks() int {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.inode.Blocks()
 }
 
 // Write - append data to File
 func (f *File) Write(p []byte) (int, error) {
-	var buffer = bytes.NewBuffer(p)
-	var left = len(p)
+	n, _, err := f.append(p)
+	return n, err
+}
 
-	// if last already existing data block have some avaivable space
-	if len(f.data) > 1 {
-		tail := f.data[len(f.data)-1]
-		free := tail.Avaivable()
-		tail.WriteAt(buffer.Next(free), blockSize-free)
-		left -= free
+// append writes p at the end of file and returns the new end offset
+func (f *File) append(p []byte) (int, int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := f.inode.Size()
+	n, err := f.fs.writeAt(f.inode, p, off)
+	if n > 0 {
+		f.fs.notifyFile(OpWrite, f)
 	}
+	return n, off + int64(n), err
+}
 
-	// required block count to write all data
-	required := left / blockSize
-	if left%blockSize != 0 {
-		required++
+// WriteAt - write data with offset
+func (f *File) WriteAt(p []byte, off int) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.fs.writeAt(f.inode, p, int64(off))
+	if n > 0 {
+		f.fs.notifyFile(OpWrite, f)
 	}
+	return n, err
+}
 
-	for i := 0; i < required; i++ {
-		block := &Block{}
-		block.Write(buffer.Next(blockSize))
-		f.data = append(f.data, block)
-	}
+// Read - read all File data
+func (f *File) Read() []byte {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
 
-	return len(p), nil
+	f.mu.RLock()
+	data := f.inode.Read()
+	f.mu.RUnlock()
+
+	f.fs.accessed(f.inode)
+	return data
 }
 
-// WriteAt - write data with offset
-func (f *File) WriteAt(p []byte, off int) (int, error) {
-	var buffer = bytes.NewBuffer(p)
-	var left = len(p)
+// ReadAt - read File data with offset, io.EOF is returned at the end of file
+func (f *File) ReadAt(p []byte, off int) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
 
-	blockOffset := off / blockSize
-	bytesOffset := off % blockSize
+	f.mu.RLock()
+	n, err := f.inode.ReadAt(p, off)
+	f.mu.RUnlock()
 
-	// fill File with empty data if offset higher than File size
-	if len(f.data) <= blockOffset {
-		var diff = blockOffset - len(f.data)
-		for i := 0; i <= diff; i++ {
-			f.data = append(f.data, &Block{data: make([]byte, blockSize)})
-		}
+	if n > 0 {
+		f.fs.accessed(f.inode)
 	}
+	return n, err
+}
 
-	head := f.data[blockOffset]
-	head.WriteAt(buffer.Next(blockSize-bytesOffset), bytesOffset)
-	left -= blockSize - bytesOffset
+// Truncate - change File size
+func (f *File) Truncate(size int) error {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	// required block count to write rest of the data
-	required := left / blockSize
-	if left%blockSize != 0 {
-		required++
+	if err := f.fs.truncate(f.inode, size); err != nil {
+		return err
 	}
+	f.fs.notifyFile(OpWrite, f)
+	return nil
+}
 
-	// append additional data to File if needed or rewrite existing
-	if len(f.data) <= blockOffset+required {
-		var diff = blockOffset + required - len(f.data)
-
-		for i := 0; i <= diff; i++ {
-			block := &Block{}
-			block.Write(buffer.Next(blockSize))
-			f.data = append(f.data, block)
-		}
-	} else {
-		for i := 1; i <= required; i++ {
-			f.data[blockOffset+i].Write(buffer.Next(blockSize))
-		}
+// writeAt writes p to n at off if there is space for it, caller holds n lock
+func (fs *MemFS) writeAt(n *inode, p []byte, off int64) (int, error) {
+	if fs.readonly() {
+		return 0, syscall.EROFS
+	}
+	if err := fs.reserve(n, off, off+int64(len(p))); err != nil {
+		return 0, err
 	}
 
-	return len(p), nil
+	fs.cow(n)
+	cnt, err := n.WriteAt(p, int(off))
+	if cnt > 0 {
+		fs.modified(n)
+		fs.log(&record{op: opWrite, ino: n.ino, off: off, data: p[:cnt], time: n.ctime})
+	}
+	return cnt, err
 }
 
-// Read - read all File data
-func (f *File) Read() []byte {
-	var buffer = new(bytes.Buffer)
-	for _, block := range f.data {
-		buffer.Write(block.Read())
+// truncate changes size of n, caller holds n lock
+func (fs *MemFS) truncate(n *inode, size int) error {
+	if fs.readonly() {
+		return syscall.EROFS
 	}
-	return buffer.Bytes()
+	if size < 0 {
+		return syscall.EINVAL
+	}
+
+	fs.cow(n)
+	count := n.Blocks()
+	if err := n.Truncate(size); err != nil {
+		return err
+	}
+	fs.reclaim(n, count)
+	fs.modified(n)
+	fs.log(&record{op: opTruncate, ino: n.ino, size: int64(size), time: n.ctime})
+	return nil
 }
 
-// ReadAt - read File data with offset
-func (f *File) ReadAt(p []byte, off int) (int, error) {
-	var buffer = new(bytes.Buffer)
+// Close the file
+func (f *File) Close() error {
+	return nil
+}
 
-	blockOffset := off / blockSize
-	bytesOffset := off % blockSize
+// Write - append data to inode
+func (n *inode) Write(p []byte) (int, error) {
+	return n.WriteAt(p, int(n.Size()))
+}
 
-	if len(f.data) <= blockOffset {
-		return 0, ErrOffsetRange
+// WriteAt - write data with offset, timestamps are left as is.
+// Only blocks the data lands in are allocated, a gap left before them is a hole.
+// Data written right after an extent extends it, so sequential writes make runs
+// of up to maxRun bytes
+func (n *inode) WriteAt(p []byte, off int) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	head, err := f.data[blockOffset].ReadAt(bytesOffset)
-	if err != nil {
-		return 0, ErrReadBytes
+	pos, end := int64(off), int64(off+len(p))
+	for pos < end {
+		e := n.data.floor(pos)
+		if e != nil && pos < e.end() {
+			e = n.own(e, pos, end)
+			pos += int64(copy(e.data[pos-e.off:], p[pos-int64(off):]))
+			continue
+		}
+
+		// allocate the gap up to the next extent or the end of written data
+		from, to := n.alignDown(pos), n.alignUp(end)
+		if next := n.data.ceil(pos); next != nil && next.off < to {
+			to = next.off
+		}
+		if e != nil && e.end() == from && len(e.data) < maxRun && !n.shared(e) {
+			n.data.resize(e, extend(e.data, int(to-from)))
+		} else {
+			n.data.insert(&extent{off: from, data: make([]byte, to-from), gen: n.gen})
+		}
 	}
-	buffer.Write(head)
 
-	for i := blockOffset + 1; i < len(f.data); i++ {
-		buffer.Write(f.data[i].Read())
+	if end > n.size {
+		n.size = end
 	}
+	return len(p), nil
+}
 
-	return buffer.Read(p)
+// Read - read all inode data
+func (n *inode) Read() []byte {
+	data := make([]byte, n.Size())
+	n.ReadAt(data, 0)
+	return data
 }
 
-// Truncate - change File size
-func (f *File) Truncate(size int) error {
-	blockCount := size / blockSize
-	bytesCount := size % blockSize
-	if bytesCount != 0 {
-		blockCount++
+// ReadAt - read inode data with offset, holes read as zeros.
+// Like io.ReaderAt it returns io.EOF if p isn't filled up to the end of data
+func (n *inode) ReadAt(p []byte, off int) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
 	}
 
-	if len(f.data) > blockCount {
-		f.data = f.data[:blockCount]
-		if bytesCount != 0 {
-			f.data[blockCount-1].Truncate(bytesCount)
-		}
-		return nil
+	var eof error
+	size := n.Size()
+	if int64(off) >= size {
+		return 0, io.EOF
 	}
-
-	var diff = blockCount - len(f.data)
-	for i := 0; i <= diff; i++ {
-		f.data = append(f.data, &Block{})
+	if max := size - int64(off); int64(len(p)) > max {
+		p = p[:max]
+		eof = io.EOF
 	}
 
+	pos, end := int64(off), int64(off+len(p))
+	n.data.ascend(pos, func(e *extent) bool {
+		if e.off >= end {
+			return false
+		}
+		// zero the hole before the extent
+		if pos < e.off {
+			zero(p[pos-int64(off) : e.off-int64(off)])
+			pos = e.off
+		}
+		pos += int64(copy(p[pos-int64(off):], e.data[pos-e.off:]))
+		return pos < end
+	})
+	zero(p[pos-int64(off):])
+
+	return len(p), eof
+}
+
+// Truncate - change inode size, growing leaves a hole at the end
+func (n *inode) Truncate(size int) error {
+	if int64(size) < n.size {
+		// bytes past the end are zero, so the last block is freed whole
+		n.punch(int64(size), n.alignUp(n.size)-int64(size))
+	}
+	n.size = int64(size)
 	return nil
 }
 
+// blocks - count of size bytes blocks holding n bytes
+func blocks(n int64, size int) int {
+	return int((n + int64(size) - 1) / int64(size))
+}
+
+// alignDown rounds off down to the block boundary
+func (n *inode) alignDown(off int64) int64 {
+	return off - off%int64(n.blksize)
+}
+
+// alignUp rounds off up to the block boundary
+func (n *inode) alignUp(off int64) int64 {
+	return n.alignDown(off + int64(n.blksize) - 1)
+}
+
 // Size in bytes
-func (f *File) Size() int64 {
-	if f.dir {
+func (n *inode) Size() int64 {
+	if n.dir {
 		return 0
 	}
-	return int64(len(f.data) * blockSize)
+	if n.symlink() {
+		return int64(len(n.target))
+	}
+	return n.size
 }
 
-// Blocks count
-func (f *File) Blocks() int {
-	return len(f.data)
+// Blocks count, holes don't take blocks
+func (n *inode) Blocks() int {
+	return int(n.data.size / int64(n.blksize))
 }
 
-// Close the file
-func (f *File) Close() error {
-	return nil
+// fileInfo - snapshot of file stats
+type fileInfo struct {
+	name  string
+	ino   uint64
+	mode  os.FileMode
+	size  int64
+	nlink int
+	uid   int
+	gid   int
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+	btime time.Time
+	fs    *MemFS
+}
+
+// info takes snapshot of n stats, caller holds the tree lock but not n lock
+func (fs *MemFS) info(name string, n *inode) *fileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return &fileInfo{
+		name:  name,
+		ino:   n.ino,
+		mode:  n.Mode(),
+		size:  n.Size(),
+		nlink: n.nlink,
+		uid:   n.uid,
+		gid:   n.gid,
+		atime: n.atime,
+		mtime: n.mtime,
+		ctime: n.ctime,
+		btime: n.btime,
+		fs:    fs,
+	}
+}
+
+// Name of the file
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+// ID of the file inode
+func (i *fileInfo) ID() uint64 {
+	return i.ino
+}
+
+// Size in bytes
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+// Mode - file mode bits
+func (i *fileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+// ModTime returns modification time
+func (i *fileInfo) ModTime() time.Time {
+	return i.mtime
+}
+
+// IsDir - check if dir
+func (i *fileInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+// Sys returns underlying data source
+func (i *fileInfo) Sys() interface{} { return i.fs }
+
+// Nlink - number of hard links
+func (i *fileInfo) Nlink() int {
+	return i.nlink
+}
+
+// Uid - owner of the file
+func (i *fileInfo) Uid() int {
+	return i.uid
+}
+
+// Gid - group of the file
+func (i *fileInfo) Gid() int {
+	return i.gid
+}
+
+// AccessTime returns access time
+func (i *fileInfo) AccessTime() time.Time {
+	return i.atime
+}
+
+// ChangeTime returns metadata change time
+func (i *fileInfo) ChangeTime() time.Time {
+	return i.ctime
+}
+
+// BirthTime returns creation time
+func (i *fileInfo) BirthTime() time.Time {
+	return i.btime
 }
@@ -1,42 +1,136 @@
 package memfs
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"os"
 	"path/filepath"
-	"sync/atomic"
+	"sync"
+	"syscall"
 	"time"
 
 	vfs "fs"
 )
 
-// MemFS - in-memory filesystem
+var (
+	// ErrIsDir -
+	ErrIsDir = errors.New("is a directory")
+	// ErrNotDir -
+	ErrNotDir = errors.New("not a directory")
+)
+
+// MemFS - in-memory filesystem, safe for concurrent use. It acts on its
+// tree with its own credential and umask, WithCred makes more views of
+// the same tree acting with other ones. Both are guarded by the tree lock
 type MemFS struct {
-	root   *File
-	wd     *File
+	*tree
+	cred  Cred
+	umask os.FileMode
+}
+
+// tree - state shared by all views of a filesystem.
+//
+// mu is the tree lock, it guards the namespace, inode metadata and settings.
+// Data of each inode is guarded by its own lock, which is taken only while
+// holding the tree lock. Locks nest in these orders, none is taken while
+// holding one coming after it:
+//
+//	Handle.mu, tree lock, inode locks in ascending inode number order
+//	Handle.mu, tree lock, locks.mu
+//	tree lock, watchMu, Watcher.mu
+//
+// Handle.Close takes Handle.mu, the tree lock and then locks.mu to release
+// locks of the handle and wake their waiters. Flock, LockRange and TestRange
+// take locks.mu alone, without Handle.mu or the tree lock, and a blocked
+// lock waits in locks.cond.Wait holding nothing else, so Close of the
+// handle it waits for can proceed. Watcher.Close takes watchMu alone
+type tree struct {
+	mu     sync.RWMutex
+	root   *inode
+	wd     *inode
 	ids    uint64
-	table  map[uint64]string
-	opened map[int]*File
+	inodes itable
+	opened fdTable
+	clock  func() time.Time
+	atime  AtimeMode
+
+	// limits set on creation and bytes taken by data blocks
+	blksize   int
+	capacity  int64
+	maxInodes int
+	used      int64
+
+	// journal of changes since the image was saved,
+	// seq is the last record applied
+	journal *journal
+	seq     uint64
+
+	// generation of changes, bumped by each snapshot
+	gen       uint64
+	snapshots []*snapshot
+
+	// mounted snapshots only: filesystem holding it
+	origin *MemFS
+	snap   *snapshot
+
+	// watches of paths, see the lock order above. watching is the count
+	// of watchers, read without the lock so changes skip it while there
+	// are none
+	watchMu  sync.Mutex
+	watchers map[*Watcher]bool
+	watching int32
+
+	// advisory locks of open handles, see the lock order above
+	locks lockTable
 }
 
-// Create a new MemFS
-func Create() *MemFS {
-	root := &File{
-		name: "/",
-		dir:  true,
-		id:   0,
+// Create a new MemFS, opts may override default settings
+func Create(opts ...Options) *MemFS {
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
 	}
-	return &MemFS{
-		root:   root,
-		wd:     root,
-		table:  make(map[uint64]string),
-		opened: make(map[int]*File),
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
 	}
+
+	now := time.Now()
+	root := &inode{
+		ino:     0,
+		dir:     true,
+		mode:    0755,
+		nlink:   2,
+		blksize: o.BlockSize,
+		entries: make(map[string]uint64),
+		atime:   now,
+		mtime:   now,
+		ctime:   now,
+		btime:   now,
+	}
+	fs := &MemFS{
+		tree: &tree{
+			root: root,
+			wd:   root,
+
+			blksize:   o.BlockSize,
+			capacity:  o.Capacity,
+			maxInodes: o.MaxInodes,
+		},
+		umask: defaultUmask,
+	}
+	fs.inodes.set(root.ino, root)
+	return fs
 }
 
 // Mkdir creates a new directory
 func (fs *MemFS) Mkdir(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdir(name)
+}
+
+func (fs *MemFS) mkdir(name string) error {
 	name = filepath.Clean(name)
 	base := filepath.Base(name)
 	parent, f, err := fs.file(name)
@@ -46,56 +140,89 @@ func (fs *MemFS) Mkdir(name string) error {
 		}
 
 		// create parent directory if it doesn't exist
-		if err := fs.Mkdir(filepath.Dir(name)); err != nil {
+		if err := fs.mkdir(filepath.Dir(name)); err != nil {
 			return err
 		}
-		_, parent, _ = fs.file(filepath.Dir(name))
+		parent, _, _ = fs.file(name)
 	}
 	if f != nil {
 		return &os.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("directory %q already exists", name)}
 	}
-
-	f = &File{
-		name:    base,
-		id:      atomic.AddUint64(&fs.ids, 1),
-		dir:     true,
-		mode:    os.ModeTemporary,
-		parent:  parent,
-		modtime: time.Now(),
-		fs:      fs,
+	if !fs.access(parent, mayWrite|mayExec) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
 	}
 
-	if parent.childs == nil {
-		parent.childs = make(map[string]*File)
+	if _, err := fs.mknod(parent, base, &inode{
+		dir:  true,
+		mode: 0777,
+	}); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
 	}
-
-	parent.childs[base] = f
-	fs.table[f.id] = f.AbsPath()
 	return nil
 }
 
 // Stat - filestats
 func (fs *MemFS) Stat(id int) (vfs.File, error) {
-	path, ok := fs.table[uint64(id)]
-	if !ok {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	f := fs.find(uint64(id))
+	if f == nil {
 		return nil, fmt.Errorf("file with id %d doesn't exist", id)
 	}
-
-	_, f, err := fs.file(path)
-	return f, err
+	return f, nil
 }
 
-// List file names inside current directory
+// List file names inside current directory,
+// nothing is listed without read permission
 func (fs *MemFS) List() []vfs.File {
-	files := make([]vfs.File, 0, len(fs.wd.childs))
-	for _, f := range fs.wd.childs {
-		files = append(files, f)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if !fs.access(fs.wd, mayRead) {
+		return nil
+	}
+	return fs.list(fs.wd)
+}
+
+// ListDir returns files of directory name without changing
+// the working directory, symlinks are followed
+func (fs *MemFS) ListDir(name string) ([]vfs.File, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	_, f, err := fs.follow(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "list", Path: name, Err: err}
+	}
+	if f == nil {
+		return nil, &os.PathError{Op: "list", Path: name, Err: os.ErrNotExist}
+	}
+	if !f.dir {
+		return nil, &os.PathError{Op: "list", Path: name, Err: ErrNotDir}
+	}
+	if !fs.access(f.inode, mayRead) {
+		return nil, &os.PathError{Op: "list", Path: name, Err: os.ErrPermission}
+	}
+	return fs.list(f.inode), nil
+}
+
+// list returns files of dir, caller holds the tree lock
+func (fs *MemFS) list(dir *inode) []vfs.File {
+	files := make([]vfs.File, 0, len(dir.entries))
+	for name := range dir.entries {
+		files = append(files, fs.view(dir, name, fs.child(dir, name)))
 	}
+	fs.accessed(dir)
 	return files
 }
 
 // Create new file
 func (fs *MemFS) Create(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
 	name = filepath.Clean(name)
 	base := filepath.Base(name)
 
@@ -106,7 +233,7 @@ func (fs *MemFS) Create(name string) error {
 		}
 
 		// create parent directory if it doesn't exist
-		if err := fs.Mkdir(filepath.Dir(name)); err != nil {
+		if err := fs.mkdir(filepath.Dir(name)); err != nil {
 			return err
 		}
 		parent, _, _ = fs.file(name)
@@ -115,87 +242,141 @@ func (fs *MemFS) Create(name string) error {
 	if f != nil {
 		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
 	}
-
-	f = &File{
-		name:    base,
-		id:      atomic.AddUint64(&fs.ids, 1),
-		dir:     false,
-		mode:    os.ModeAppend,
-		parent:  parent,
-		modtime: time.Now(),
-		fs:      fs,
+	if !fs.access(parent, mayWrite|mayExec) {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
 	}
 
-	parent.childs[base] = f
-	fs.table[f.id] = f.AbsPath()
-	f.modtime = time.Now()
+	if _, err := fs.mknod(parent, base, &inode{
+		mode: 0666,
+	}); err != nil {
+		return &os.PathError{Op: "create", Path: name, Err: err}
+	}
 	return nil
 }
 
-// Open opens file by its name
+// Open opens file for reading and writing, returns its descriptor
 func (fs *MemFS) Open(name string) (int, error) {
+	h, err := fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	return h.fd, nil
+}
+
+// OpenFile opens file with os.OpenFile style flags, symlinks are followed.
+// perm masked with umask is used for files created with O_CREATE
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (*Handle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
 	name = filepath.Clean(name)
 	base := filepath.Base(name)
 
-	_, f, err := fs.file(name)
+	// O_EXCL doesn't follow symlink, even a dangling one is an existing file
+	follow := flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL
+	parent, entry, node, err := fs.walk(name, follow)
 	if err != nil {
-		return 0, &os.PathError{Op: "open", Path: name, Err: err}
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
 
-	if f == nil {
-		return 0, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	created := node == nil
+	if created {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if !fs.access(parent, mayWrite|mayExec) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		node, err = fs.mknod(parent, entry, &inode{
+			mode: perm & modeChmod,
+		})
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	} else if !follow {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	} else if node.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("%q is a directory", base)}
+	} else if fs.readonly() && (flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
 	}
-	if f.dir {
-		return 0, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("%q is a directory", base)}
+
+	f := fs.entryView(parent, entry, node)
+	h := &Handle{
+		fs:   fs,
+		file: f,
+		name: name,
+		flag: flag,
 	}
 
-	var symflag = make([]byte, 4)
-	_, err = f.ReadAt(symflag, 0)
-	if err == nil && string(symflag) == "sym:" {
-		path := string(f.Read())[4:]
-		return fs.Open(path)
+	// permissions of a just created file don't restrict its creator
+	var mask os.FileMode
+	if h.readable() {
+		mask |= mayRead
+	}
+	if h.writable() || flag&os.O_TRUNC != 0 {
+		mask |= mayWrite
+	}
+	if !created && !fs.access(node, mask) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	if flag&os.O_TRUNC != 0 && h.writable() {
+		if err := fs.truncate(node, 0); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		fs.notifyFile(OpWrite, f)
 	}
 
-	fd := rand.Intn(1000)
-	if _, ok := fs.opened[fd]; ok {
-		return 0, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("%q is already opened", name)}
+	// inodes of mounted snapshots are shared by all its mounts
+	if !fs.readonly() {
+		f.opened++
 	}
-	fs.opened[fd] = f
+	fs.opened.alloc(h)
+	return h, nil
+}
 
-	return fd, nil
+// Handle returns handle opened with descriptor fd
+func (fs *MemFS) Handle(fd int) (*Handle, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.opened.get(fd)
 }
 
 // Close the file
 func (fs *MemFS) Close(fd int) error {
-	delete(fs.opened, fd)
-	return nil
+	h, err := fs.Handle(fd)
+	if err != nil {
+		return err
+	}
+	return h.Close()
 }
 
 // Read specified size with offset
 func (fs *MemFS) Read(fd, off, size int) (string, error) {
-	f, ok := fs.opened[fd]
-	if !ok {
-		return "", fmt.Errorf("file isn't opened")
+	h, err := fs.Handle(fd)
+	if err != nil {
+		return "", err
 	}
 
 	var data = make([]byte, size)
-	if _, err := f.ReadAt(data, off); err != nil {
+	n, err := h.ReadAt(data, int64(off))
+	if err != nil && err != io.EOF {
 		return "", err
 	}
-	return string(data), nil
+	return string(data[:n]), nil
 }
 
 // Write data with specified size and offset
 func (fs *MemFS) Write(fd, off, size int, data string) (string, error) {
-	f, ok := fs.opened[fd]
-	if !ok {
-		return "", fmt.Errorf("file isn't opened")
+	h, err := fs.Handle(fd)
+	if err != nil {
+		return "", err
 	}
 
 	if len(data) > size {
 		data = data[:size]
 	}
-	n, err := f.WriteAt([]byte(data), off)
+	n, err := h.WriteAt([]byte(data), int64(off))
 	if err != nil {
 		return "", err
 	}
@@ -205,39 +386,67 @@ func (fs *MemFS) Write(fd, off, size int, data string) (string, error) {
 
 // Truncate file size
 func (fs *MemFS) Truncate(name string, size int) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
 	name = filepath.Clean(name)
-	_, f, err := fs.file(name)
+	_, f, err := fs.follow(name)
 	if err != nil {
-		return &os.PathError{Op: "readdir", Path: name, Err: err}
+		return &os.PathError{Op: "truncate", Path: name, Err: err}
 	}
 	if f == nil || f.dir {
-		return &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+		return &os.PathError{Op: "truncate", Path: name, Err: os.ErrNotExist}
+	}
+	if !fs.access(f.inode, mayWrite) {
+		return &os.PathError{Op: "truncate", Path: name, Err: os.ErrPermission}
 	}
 
-	return f.Truncate(size)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := fs.truncate(f.inode, size); err != nil {
+		return &os.PathError{Op: "truncate", Path: name, Err: err}
+	}
+	fs.notifyFile(OpWrite, f)
+	return nil
 }
 
 // Cd change directory
 func (fs *MemFS) Cd(path string) error {
-	_, f, err := fs.file(filepath.Clean(path))
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, f, err := fs.follow(filepath.Clean(path))
 	if err != nil {
 		return &os.PathError{Op: "cd", Path: path, Err: err}
 	}
 	if f == nil || !f.dir {
 		return &os.PathError{Op: "cd", Path: path, Err: fmt.Errorf("not a directory")}
 	}
+	if !fs.access(f.inode, mayExec) {
+		return &os.PathError{Op: "cd", Path: path, Err: os.ErrPermission}
+	}
 
-	fs.wd = f
+	fs.wd = f.inode
 	return nil
 }
 
 // Pwd - get working directory
 func (fs *MemFS) Pwd() string {
-	return fs.wd.AbsPath()
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.path(fs.wd)
 }
 
 // Link name2 to name1
 func (fs *MemFS) Link(name1, name2 string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "link", Path: name2, Err: syscall.EROFS}
+	}
+
 	name1 = filepath.Clean(name1)
 	name2 = filepath.Clean(name2)
 	_, f, err := fs.file(name1)
@@ -248,89 +457,241 @@ func (fs *MemFS) Link(name1, name2 string) error {
 		return &os.PathError{Op: "link", Path: name1, Err: os.ErrNotExist}
 	}
 
-	if err := fs.Create(name2); err != nil {
-		return err
+	parent, link, err := fs.file(name2)
+	if err != nil {
+		return &os.PathError{Op: "link", Path: name2, Err: err}
+	}
+	if link != nil {
+		return &os.PathError{Op: "link", Path: name2, Err: os.ErrExist}
+	}
+	if !fs.access(parent, mayWrite|mayExec) {
+		return &os.PathError{Op: "link", Path: name2, Err: os.ErrPermission}
 	}
-	f.links = append(f.links, name2)
 
-	_, link, _ := fs.file(name2)
-	link.data = f.data
-	link.linked = f.AbsPath()
+	fs.link(parent, filepath.Base(name2), f.inode)
+	fs.log(&record{op: opLink, parent: parent.ino, name: filepath.Base(name2), ino: f.ino})
+	fs.notify(OpCreate, parent, filepath.Base(name2))
+	fs.notifyFile(OpAttrib, f)
 	return nil
 }
 
-// Ln - create symlink
+// Rename moves oldname to newname, replacing newname if it exists.
+// A replaced directory must be empty and a directory can't be moved
+// into its own subtree. Symlinks are renamed, not followed
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+	}
+
+	oldname = filepath.Clean(oldname)
+	newname = filepath.Clean(newname)
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	for _, name := range []string{oldname, newname} {
+		if base := filepath.Base(name); base == "." || base == ".." {
+			return fail(syscall.EINVAL)
+		}
+	}
+
+	oldParent, oldEntry, n, err := fs.walk(oldname, false)
+	if err != nil {
+		return fail(err)
+	}
+	if n == nil {
+		return fail(os.ErrNotExist)
+	}
+	if n == fs.root {
+		return fail(syscall.EBUSY)
+	}
+
+	newParent, newEntry, target, err := fs.walk(newname, false)
+	if err != nil {
+		return fail(err)
+	}
+	if target == fs.root {
+		return fail(syscall.EBUSY)
+	}
+
+	// links to the same file, nothing to do
+	if target == n {
+		return nil
+	}
+
+	if n.dir && fs.contains(n, newParent) {
+		return fail(syscall.EINVAL)
+	}
+	if target != nil {
+		switch {
+		case n.dir && !target.dir:
+			return fail(ErrNotDir)
+		case !n.dir && target.dir:
+			return fail(ErrIsDir)
+		case target.dir && len(target.entries) > 0:
+			return fail(syscall.ENOTEMPTY)
+		case target == fs.wd:
+			return fail(syscall.EBUSY)
+		}
+	}
+
+	if !fs.mayDelete(oldParent, n) || !fs.access(newParent, mayWrite|mayExec) {
+		return fail(os.ErrPermission)
+	}
+	if target != nil && !fs.mayDelete(newParent, target) {
+		return fail(os.ErrPermission)
+	}
+	// ".." of the moved directory is rewritten
+	if n.dir && oldParent != newParent && !fs.access(n, mayWrite) {
+		return fail(os.ErrPermission)
+	}
+
+	fs.rename(oldParent, oldEntry, newParent, newEntry)
+	fs.log(&record{
+		op:        opRename,
+		parent:    oldParent.ino,
+		name:      oldEntry,
+		newParent: newParent.ino,
+		newName:   newEntry,
+	})
+	fs.notifyRename(oldParent, oldEntry, newParent, newEntry)
+	return nil
+}
+
+// rename moves entry of oldParent to newParent replacing the existing one
+func (fs *MemFS) rename(oldParent *inode, oldEntry string, newParent *inode, newEntry string) {
+	n := fs.child(oldParent, oldEntry)
+	if fs.child(newParent, newEntry) != nil {
+		fs.unlink(newParent, newEntry)
+	}
+	fs.link(newParent, newEntry, n)
+	fs.unlink(oldParent, oldEntry)
+	fs.renamed(oldParent, oldEntry, newParent, newEntry)
+}
+
+// Ln - create symlink name2 pointing to name1
 func (fs *MemFS) Ln(name1, name2 string) error {
-	name1 = filepath.Clean(name1)
-	name2 = filepath.Clean(name2)
-	_, f, err := fs.file(name1)
+	return fs.Symlink(name1, name2)
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+// oldname is stored as is and doesn't have to exist,
+// relative links are resolved from the directory holding the link
+func (fs *MemFS) Symlink(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	newname = filepath.Clean(newname)
+	if oldname == "" {
+		return &os.PathError{Op: "symlink", Path: newname, Err: os.ErrNotExist}
+	}
+
+	parent, f, err := fs.file(newname)
 	if err != nil {
-		return &os.PathError{Op: "ln", Path: name1, Err: err}
+		return &os.PathError{Op: "symlink", Path: newname, Err: err}
 	}
-	if f == nil || f.dir {
-		return &os.PathError{Op: "ln", Path: name1, Err: os.ErrNotExist}
+	if f != nil {
+		return &os.PathError{Op: "symlink", Path: newname, Err: os.ErrExist}
+	}
+	if !fs.access(parent, mayWrite|mayExec) {
+		return &os.PathError{Op: "symlink", Path: newname, Err: os.ErrPermission}
 	}
 
-	if err := fs.Create(name2); err != nil {
-		return err
+	if _, err := fs.mknod(parent, filepath.Base(newname), &inode{
+		mode:   os.ModeSymlink | os.ModePerm,
+		target: oldname,
+	}); err != nil {
+		return &os.PathError{Op: "symlink", Path: newname, Err: err}
 	}
-	_, symlink, _ := fs.file(name2)
-	_, err = symlink.WriteAt([]byte("sym:"+f.AbsPath()), 0)
-	return err
+	return nil
 }
 
-// Unlink file
-func (fs *MemFS) Unlink(name string) error {
+// Readlink returns the destination of the named symbolic link
+func (fs *MemFS) Readlink(name string) (string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
 	name = filepath.Clean(name)
-	p, f, err := fs.file(name)
+	_, f, err := fs.file(name)
 	if err != nil {
-		return &os.PathError{Op: "unlink", Path: name, Err: err}
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
 	}
-	if f == nil || f.dir {
-		return &os.PathError{Op: "unlink", Path: name, Err: os.ErrNotExist}
+	if f == nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
 	}
-
-	var symflag = make([]byte, 4)
-	_, err = f.ReadAt(symflag, 0)
-	if err == nil && string(symflag) == "sym:" {
-		return fs.Remove(name)
+	if !f.symlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
 	}
 
-	_, parent, err := fs.file(f.linked)
-	if err == nil {
-		for i, link := range parent.links {
-			if link == f.name {
-				if len(parent.links)+1 > i {
-					parent.links = append(parent.links[:i], parent.links[i+1:]...)
-				} else {
-					parent.links = parent.links[:i]
-				}
-			}
-		}
+	return f.target, nil
+}
+
+// Lstat returns file stats, symlink itself is described if name is a link
+func (fs *MemFS) Lstat(name string) (os.FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	_, f, err := fs.file(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	if f == nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
 	}
 
-	delete(p.childs, f.name)
-	return nil
+	return fs.info(f.name, f.inode), nil
+}
+
+// Unlink file
+func (fs *MemFS) Unlink(name string) error {
+	return fs.unlinkName("unlink", name)
 }
 
 // Remove file
 func (fs *MemFS) Remove(name string) error {
+	return fs.unlinkName("remove", name)
+}
+
+// unlinkName removes entry name of a file, errors report op
+func (fs *MemFS) unlinkName(op, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+	}
+
 	name = filepath.Clean(name)
 	parent, f, err := fs.file(name)
 	if err != nil {
-		return &os.PathError{Op: "remove", Path: name, Err: err}
+		return &os.PathError{Op: op, Path: name, Err: err}
 	}
 	if f == nil || f.dir {
-		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !fs.mayDelete(parent, f.inode) {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
 	}
 
-	delete(parent.childs, f.name)
-	delete(fs.table, f.id)
+	fs.unlink(parent, f.name)
+	fs.log(&record{op: opUnlink, parent: parent.ino, name: f.name})
+	fs.notify(OpRemove, parent, f.name)
 	return nil
 }
 
 // RemoveDir -
 func (fs *MemFS) RemoveDir(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "rmdir", Path: name, Err: syscall.EROFS}
+	}
+
 	name = filepath.Clean(name)
 	parent, f, err := fs.file(name)
 	if err != nil {
@@ -339,23 +700,42 @@ func (fs *MemFS) RemoveDir(name string) error {
 	if f == nil || !f.dir {
 		return &os.PathError{Op: "rmdir", Path: name, Err: os.ErrNotExist}
 	}
-	if len(f.childs) > 0 {
-		return fmt.Errorf("directory is not empty")
+	if parent == nil || f.inode == fs.wd {
+		return &os.PathError{Op: "rmdir", Path: name, Err: syscall.EBUSY}
+	}
+	if !fs.mayDelete(parent, f.inode) {
+		return &os.PathError{Op: "rmdir", Path: name, Err: os.ErrPermission}
+	}
+	if len(f.entries) > 0 {
+		return &os.PathError{Op: "rmdir", Path: name, Err: syscall.ENOTEMPTY}
 	}
 
-	delete(parent.childs, f.name)
+	fs.unlink(parent, f.name)
+	fs.log(&record{op: opUnlink, parent: parent.ino, name: f.name})
+	fs.notify(OpRemove, parent, f.name)
 	return nil
 }
 
 // Cat - print file data
 func (fs *MemFS) Cat(name string) (string, error) {
-	_, f, err := fs.file(name)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	_, f, err := fs.follow(name)
 	if err != nil {
 		return "", &os.PathError{Op: "cat", Path: name, Err: err}
 	}
 	if f == nil || f.dir {
 		return "", &os.PathError{Op: "cat", Path: name, Err: os.ErrNotExist}
 	}
+	if !fs.access(f.inode, mayRead) {
+		return "", &os.PathError{Op: "cat", Path: name, Err: os.ErrPermission}
+	}
 
-	return string(f.Read()), nil
+	f.mu.RLock()
+	data := f.inode.Read()
+	f.mu.RUnlock()
+
+	fs.accessed(f.inode)
+	return string(data), nil
 }
@@ -0,0 +1,28 @@
+package memfs_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"fs/memfs"
+)
+
+func TestRemoveDirNotEmpty(t *testing.T) {
+	fs := memfs.Create()
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/dir/f", "data")
+
+	err := fs.RemoveDir("/dir")
+	if !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("RemoveDir of non-empty directory: %v, want ENOTEMPTY", err)
+	}
+	if err := fs.Unlink("/dir/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+}
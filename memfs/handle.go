@@ -0,0 +1,265 @@
+package memfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrBadFd - descriptor isn't open or doesn't allow the operation
+	ErrBadFd = errors.New("bad file descriptor")
+	// ErrWhence -
+	ErrWhence = errors.New("invalid whence")
+	// ErrNegativeOffset -
+	ErrNegativeOffset = errors.New("negative offset")
+	// ErrAppendWriteAt - WriteAt can't be used on O_APPEND handles
+	ErrAppendWriteAt = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+)
+
+// Handle - opened file with its own offset and access mode.
+// mu guards offset and closed flag
+type Handle struct {
+	mu     sync.RWMutex
+	fs     *MemFS
+	file   *File
+	name   string
+	fd     int
+	flag   int
+	off    int64
+	closed bool
+
+	// locks of the handle were released by Close, guarded by the lock table
+	unlocked bool
+}
+
+var (
+	_ io.Reader   = (*Handle)(nil)
+	_ io.Writer   = (*Handle)(nil)
+	_ io.Seeker   = (*Handle)(nil)
+	_ io.ReaderAt = (*Handle)(nil)
+	_ io.WriterAt = (*Handle)(nil)
+	_ io.Closer   = (*Handle)(nil)
+)
+
+// Fd returns descriptor of the handle
+func (h *Handle) Fd() int {
+	return h.fd
+}
+
+// Name of the file as passed to OpenFile
+func (h *Handle) Name() string {
+	return h.name
+}
+
+// Stat returns stats of the opened file
+func (h *Handle) Stat() (os.FileInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return nil, h.error("stat", os.ErrClosed)
+	}
+	return h.file.stat(), nil
+}
+
+func (h *Handle) readable() bool {
+	return h.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (h *Handle) writable() bool {
+	return h.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_RDONLY
+}
+
+func (h *Handle) error(op string, err error) error {
+	return &os.PathError{Op: op, Path: h.name, Err: err}
+}
+
+// check that handle is usable for op
+func (h *Handle) check(op string, write bool) error {
+	if h.closed {
+		return h.error(op, os.ErrClosed)
+	}
+	if write && !h.writable() || !write && !h.readable() {
+		return h.error(op, ErrBadFd)
+	}
+	return nil
+}
+
+// Read reads up to len(p) bytes from current offset
+func (h *Handle) Read(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.check("read", false); err != nil {
+		return 0, err
+	}
+
+	n, err := h.file.ReadAt(p, int(h.off))
+	h.off += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off, doesn't move the offset
+func (h *Handle) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := h.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, h.error("read", ErrNegativeOffset)
+	}
+
+	return h.file.ReadAt(p, int(off))
+}
+
+// Write writes p at current offset, or at the end of file for O_APPEND
+func (h *Handle) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.check("write", true); err != nil {
+		return 0, err
+	}
+
+	// finding the end and writing there must be atomic
+	if h.flag&os.O_APPEND != 0 {
+		n, end, err := h.file.append(p)
+		h.off = end
+		return n, err
+	}
+	n, err := h.file.WriteAt(p, int(h.off))
+	h.off += int64(n)
+	return n, err
+}
+
+// WriteAt writes p starting at off, doesn't move the offset
+func (h *Handle) WriteAt(p []byte, off int64) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := h.check("write", true); err != nil {
+		return 0, err
+	}
+	if h.flag&os.O_APPEND != 0 {
+		return 0, h.error("write", ErrAppendWriteAt)
+	}
+	if off < 0 {
+		return 0, h.error("write", ErrNegativeOffset)
+	}
+
+	return h.file.WriteAt(p, int(off))
+}
+
+// Seek sets offset for the next Read or Write,
+// whence SeekData and SeekHole look for data regions of sparse files
+func (h *Handle) Seek(offset int64, whence int) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return 0, h.error("seek", os.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.off
+	case io.SeekEnd:
+		offset += h.file.Size()
+	case SeekData, SeekHole:
+		pos, err := h.file.seek(offset, whence)
+		if err != nil {
+			return 0, h.error("seek", err)
+		}
+		offset = pos
+	default:
+		return 0, h.error("seek", ErrWhence)
+	}
+	if offset < 0 {
+		return 0, h.error("seek", ErrNegativeOffset)
+	}
+
+	h.off = offset
+	return offset, nil
+}
+
+// Truncate changes size of the opened file
+func (h *Handle) Truncate(size int64) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := h.check("truncate", true); err != nil {
+		return err
+	}
+	return h.file.Truncate(int(size))
+}
+
+// Close the handle and release its descriptor
+func (h *Handle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return h.error("close", os.ErrClosed)
+	}
+
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	h.closed = true
+	h.fs.opened.release(h.fd)
+	h.fs.locks.release(h)
+	if !h.fs.readonly() {
+		h.file.opened--
+		h.fs.release(h.file.inode)
+	}
+	if h.writable() {
+		h.fs.notifyFile(OpCloseWrite, h.file)
+	}
+	return nil
+}
+
+// fdTable - descriptor table, hands out the lowest free descriptor
+type fdTable struct {
+	handles []*Handle
+}
+
+// alloc assigns the lowest free descriptor to h
+func (t *fdTable) alloc(h *Handle) int {
+	for fd, slot := range t.handles {
+		if slot == nil {
+			t.handles[fd] = h
+			h.fd = fd
+			return fd
+		}
+	}
+
+	t.handles = append(t.handles, h)
+	h.fd = len(t.handles) - 1
+	return h.fd
+}
+
+// get returns handle opened with descriptor fd
+func (t *fdTable) get(fd int) (*Handle, error) {
+	if fd < 0 || fd >= len(t.handles) || t.handles[fd] == nil {
+		return nil, ErrBadFd
+	}
+	return t.handles[fd], nil
+}
+
+// release frees descriptor fd
+func (t *fdTable) release(fd int) {
+	if fd < 0 || fd >= len(t.handles) {
+		return
+	}
+	t.handles[fd] = nil
+
+	// shrink table tail so it doesn't grow forever
+	for len(t.handles) > 0 && t.handles[len(t.handles)-1] == nil {
+		t.handles = t.handles[:len(t.handles)-1]
+	}
+}
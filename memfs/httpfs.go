@@ -0,0 +1,201 @@
+package memfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HTTPFS adapts MemFS to http.FileSystem. Files are opened through IOFS,
+// so they are read with the credential of the MemFS and symlinks are followed
+type HTTPFS struct {
+	fs *MemFS
+
+	// ETags of files by inode number, hashed again when the file changes
+	mu   sync.Mutex
+	tags map[uint64]etag
+}
+
+// etag - ETag of file data as of its size and modification and change times
+type etag struct {
+	size         int64
+	mtime, ctime time.Time
+	tag          string
+}
+
+// matches checks that info describes the same data the tag was made of
+func (e *etag) matches(info *fileInfo) bool {
+	return e.size == info.size && e.mtime.Equal(info.mtime) && e.ctime.Equal(info.ctime)
+}
+
+var (
+	_ http.FileSystem = (*HTTPFS)(nil)
+	_ http.File       = (*httpFile)(nil)
+	_ http.File       = (*httpDir)(nil)
+)
+
+// HTTPFS returns http.FileSystem view of the filesystem rooted at "/"
+func (fs *MemFS) HTTPFS() *HTTPFS {
+	return &HTTPFS{fs: fs, tags: make(map[uint64]etag)}
+}
+
+// Open opens the named file for reading, name is slash separated
+func (s *HTTPFS) Open(name string) (http.File, error) {
+	f, err := s.fs.IOFS().Open(iopath(path.Clean("/" + name)))
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case *ioDir:
+		return &httpDir{f}, nil
+	case *ioFile:
+		return &httpFile{f}, nil
+	}
+	f.Close()
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+}
+
+// FileServer returns http.FileServer of the filesystem which sets
+// content hash ETag of served files, so If-None-Match and If-Range
+// requests are answered without sending unchanged data
+func (s *HTTPFS) FileServer() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(&taggedFS{HTTPFS: s, header: w.Header()}).ServeHTTP(w, r)
+	})
+}
+
+// taggedFS - HTTPFS serving one request. It sets ETag of the regular
+// file http.FileServer opens, so the tag is of the file being served
+type taggedFS struct {
+	*HTTPFS
+	header http.Header
+}
+
+// Open opens the named file, setting ETag of a regular file
+func (t *taggedFS) Open(name string) (http.File, error) {
+	f, err := t.HTTPFS.Open(name)
+	if file, ok := f.(*httpFile); ok {
+		if tag, err := t.etag(file); err == nil {
+			t.header.Set("Etag", tag)
+		}
+	}
+	return f, err
+}
+
+// etag returns ETag of f, its data is hashed only if the file
+// changed since the cached tag was made
+func (s *HTTPFS) etag(f *httpFile) (string, error) {
+	info := f.file.stat()
+	s.mu.Lock()
+	cached, ok := s.tags[info.ino]
+	s.mu.Unlock()
+	if ok && cached.matches(info) {
+		return cached.tag, nil
+	}
+
+	tag, err := f.ETag()
+	if err != nil {
+		return "", err
+	}
+	// data changed while it was hashed has no tag
+	made := etag{size: info.size, mtime: info.mtime, ctime: info.ctime, tag: tag}
+	if !made.matches(f.file.stat()) {
+		return "", &os.PathError{Op: "etag", Path: f.name, Err: syscall.EAGAIN}
+	}
+	s.mu.Lock()
+	s.tags[info.ino] = made
+	s.mu.Unlock()
+	return tag, nil
+}
+
+// httpFile - regular file opened through HTTPFS
+type httpFile struct {
+	*ioFile
+}
+
+// Seek sets offset of the next Read
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.file.Size()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: ErrWhence}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: ErrNegativeOffset}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Readdir - regular files have no entries
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: ErrNotDir}
+}
+
+// ETag returns strong entity tag of the file, a hash of its data.
+// Offset of the file isn't changed
+func (f *httpFile) ETag() (string, error) {
+	if f.closed {
+		return "", &os.PathError{Op: "etag", Path: f.name, Err: os.ErrClosed}
+	}
+
+	h := sha256.New()
+	buf := make([]byte, 32*1024)
+	for off := 0; ; {
+		n, err := f.file.ReadAt(buf, off)
+		h.Write(buf[:n])
+		off += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// httpDir - directory opened through HTTPFS, entries are listed at open
+type httpDir struct {
+	*ioDir
+}
+
+// Seek can only rewind the listing
+func (d *httpDir) Seek(offset int64, whence int) (int64, error) {
+	if d.closed {
+		return 0, &os.PathError{Op: "seek", Path: d.info.name, Err: os.ErrClosed}
+	}
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: d.info.name, Err: syscall.EINVAL}
+	}
+	d.off = 0
+	return 0, nil
+}
+
+// Readdir returns the next count entries, or all remaining if count <= 0
+func (d *httpDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.ReadDir(count)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
@@ -0,0 +1,103 @@
+package memfs_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha256Tag returns ETag FileServer is expected to set for data
+func sha256Tag(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestFileServer(t *testing.T) {
+	fs, clock := clocked()
+	for _, dir := range []string{"/dir", "/site"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, fs, "/f.txt", "0123456789")
+	writeFile(t, fs, "/dir/a", "a")
+	writeFile(t, fs, "/dir/b", "b")
+	writeFile(t, fs, "/site/index.html", "<p>index</p>")
+	srv := fs.HTTPFS().FileServer()
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	full := get("/f.txt")
+	tag := full.Header().Get("Etag")
+	if full.Code != http.StatusOK || full.Body.String() != "0123456789" || tag != sha256Tag("0123456789") {
+		t.Fatalf("get: %d %q, etag %s", full.Code, full.Body, tag)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header []string
+		code   int
+		body   string
+	}{
+		{"range", "/f.txt", []string{"Range", "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{"if-range", "/f.txt", []string{"Range", "bytes=2-4", "If-Range", tag}, http.StatusPartialContent, "234"},
+		{"if-none-match", "/f.txt", []string{"If-None-Match", tag}, http.StatusNotModified, ""},
+		{"if-none-match other", "/f.txt", []string{"If-None-Match", `"other"`}, http.StatusOK, "0123456789"},
+		{"if-modified-since", "/f.txt", []string{"If-Modified-Since", full.Header().Get("Last-Modified")}, http.StatusNotModified, ""},
+		{"modified since", "/f.txt", []string{"If-Modified-Since", clock.now.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "0123456789"},
+		{"index", "/site/", nil, http.StatusOK, "<p>index</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.path, tt.header...)
+			if w.Code != tt.code || w.Body.String() != tt.body {
+				t.Errorf("%d %q, want %d %q", w.Code, w.Body, tt.code, tt.body)
+			}
+		})
+	}
+
+	if tag := get("/site/").Header().Get("Etag"); tag != sha256Tag("<p>index</p>") {
+		t.Errorf("index etag %s", tag)
+	}
+
+	t.Run("listing", func(t *testing.T) {
+		w := get("/dir/")
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, `<a href="a">a</a>`) || !strings.Contains(body, `<a href="b">b</a>`) {
+			t.Errorf("%d %q", w.Code, body)
+		}
+		if tag := w.Header().Get("Etag"); tag != "" {
+			t.Errorf("listing has etag %s", tag)
+		}
+	})
+
+	// a changed file gets a new tag, the old one no longer matches
+	clock.tick(time.Second)
+	h, err := fs.OpenFile("/f.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt([]byte("ab"), 0); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	w := get("/f.txt", "If-None-Match", tag)
+	if w.Code != http.StatusOK || w.Body.String() != "ab23456789" || w.Header().Get("Etag") != sha256Tag("ab23456789") {
+		t.Errorf("changed file: %d %q, etag %s", w.Code, w.Body, w.Header().Get("Etag"))
+	}
+}
@@ -0,0 +1,661 @@
+package memfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Image layout, all numbers are little endian:
+//
+//	superblock   magic, version, settings, inode, block and snapshot counts,
+//	             journal sequence, crc32
+//	inode table  variable length inode records
+//	tables       indices of inode records in the live tree followed by
+//	             names, creation times and indices of the snapshots
+//	block bitmap one bit per block of the data region, set for used blocks
+//	data region  blocks referenced by extents of the inode records
+//
+// Inodes and extents shared by snapshots are written once. Data of extents
+// is laid out in order of their first reference, so both Save and Load
+// stream it without holding the whole image in memory.
+// Images before version 3 hold the live tree only, in record order
+const (
+	imageMagic   = "MEMFSIMG"
+	imageVersion = 3
+
+	// superblock size without the trailing checksum, version 1 has
+	// no journal sequence and version 2 no snapshot count
+	superSize   = 72
+	superSizeV2 = 64
+	superSizeV1 = 56
+)
+
+var (
+	// ErrImageFormat - image is damaged or isn't a MemFS image
+	ErrImageFormat = errors.New("invalid image format")
+	// ErrImageVersion - image was written by a newer version
+	ErrImageVersion = errors.New("unsupported image version")
+)
+
+// superblock - image header
+type superblock struct {
+	Version   uint32
+	BlockSize uint32
+	Capacity  int64
+	MaxInodes int64
+	Ids       uint64
+	Inodes    uint64
+	Blocks    uint64
+	// Seq - last journal record folded into the image
+	Seq       uint64
+	Snapshots uint64
+}
+
+// isImage checks if data starts with the image magic number
+func isImage(data []byte) bool {
+	return string(data) == imageMagic
+}
+
+// WriteTo writes binary image of the filesystem to w.
+// Inodes are kept unchanged until the image is written
+func (fs *MemFS) WriteTo(w io.Writer) (int64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.writeImage(w)
+}
+
+// writeImage writes the image, caller holds the tree lock
+func (fs *MemFS) writeImage(w io.Writer) (int64, error) {
+	var (
+		nodes  []*inode
+		index  = make(map[*inode]uint64)
+		locked = make(map[*inode]bool)
+	)
+	defer func() {
+		for n := range locked {
+			n.mu.RUnlock()
+		}
+	}()
+
+	// table lists versions of inodes seen by generation gen
+	table := func(t *itable, gen uint64) []uint64 {
+		var refs []uint64
+		t.ascend(func(n *inode) bool {
+			if !locked[n] {
+				n.mu.RLock()
+				locked[n] = true
+			}
+			v := n.at(gen)
+			// skip unlinked inodes kept alive by open handles
+			if v == nil || v.nlink == 0 {
+				return true
+			}
+			i, ok := index[v]
+			if !ok {
+				i = uint64(len(nodes))
+				index[v] = i
+				nodes = append(nodes, v)
+			}
+			refs = append(refs, i)
+			return true
+		})
+		return refs
+	}
+	live := table(&fs.inodes, fs.gen)
+	snapshots := make([][]uint64, len(fs.snapshots))
+	for i, s := range fs.snapshots {
+		snapshots[i] = table(&s.inodes, s.gen)
+	}
+
+	// extents get blocks in order of their first reference
+	var (
+		runs   []*extent
+		first  = make(map[*extent]uint64)
+		blocks uint64
+	)
+	for _, n := range nodes {
+		n.data.ascend(0, func(e *extent) bool {
+			if _, ok := first[e]; !ok {
+				first[e] = blocks
+				runs = append(runs, e)
+				blocks += uint64(len(e.data) / n.blksize)
+			}
+			return true
+		})
+	}
+
+	iw := &imageWriter{w: bufio.NewWriter(w)}
+	iw.super(&superblock{
+		Version:   imageVersion,
+		BlockSize: uint32(fs.blksize),
+		Capacity:  fs.capacity,
+		MaxInodes: int64(fs.maxInodes),
+		Ids:       fs.ids,
+		Inodes:    uint64(len(nodes)),
+		Blocks:    blocks,
+		Seq:       fs.seq,
+		Snapshots: uint64(len(fs.snapshots)),
+	})
+
+	for _, n := range nodes {
+		iw.inode(n, first)
+	}
+
+	iw.table(live)
+	for i, s := range fs.snapshots {
+		iw.str(s.name)
+		iw.time(s.created)
+		iw.table(snapshots[i])
+	}
+
+	// the data region is written compactly, every block is used
+	bitmap := make([]byte, (blocks+7)/8)
+	for i := uint64(0); i < blocks; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+	iw.bytes(bitmap)
+
+	for _, e := range runs {
+		iw.bytes(e.data)
+		if iw.err != nil {
+			break
+		}
+	}
+
+	if iw.err == nil {
+		iw.err = iw.w.Flush()
+	}
+	return iw.n, iw.err
+}
+
+// ReadFrom replaces the filesystem with the image read from r
+func (fs *MemFS) ReadFrom(r io.Reader) (int64, error) {
+	ir := &imageReader{r: bufio.NewReader(r)}
+	sb := ir.super()
+	if ir.err != nil {
+		return ir.n, ir.err
+	}
+	if sb.BlockSize == 0 || sb.Inodes == 0 {
+		return ir.n, ErrImageFormat
+	}
+
+	blksize := int(sb.BlockSize)
+	ext := &imageExtents{first: make(map[uint64]*extent), blocks: sb.Blocks}
+	nodes := make([]*inode, 0)
+	for i := uint64(0); i < sb.Inodes && ir.err == nil; i++ {
+		n := ir.inode(blksize, ext)
+		if ir.err == nil {
+			nodes = append(nodes, n)
+		}
+	}
+
+	// older images hold the live tree only
+	var (
+		live      itable
+		snapshots []*snapshot
+	)
+	if sb.Version < 3 {
+		for i := range nodes {
+			ir.add(&live, nodes, uint64(i))
+		}
+	} else {
+		live = ir.table(nodes)
+		for i := uint64(0); i < sb.Snapshots && ir.err == nil; i++ {
+			s := &snapshot{name: ir.str(), created: ir.time(), gen: i}
+			s.inodes = ir.table(nodes)
+			snapshots = append(snapshots, s)
+		}
+	}
+
+	bitmap := make([]byte, (sb.Blocks+7)/8)
+	ir.full(bitmap)
+
+	// extents take blocks of the data region one after another
+	var next uint64
+	for _, e := range ext.order {
+		count := uint64(len(e.data) / blksize)
+		if !allSet(bitmap, next, count) {
+			ir.fail(ErrImageFormat)
+		}
+		ir.full(e.data)
+		next += count
+		if ir.err != nil {
+			break
+		}
+	}
+	if ir.err != nil {
+		return ir.n, ir.err
+	}
+
+	gen, err := generations(nodes, &live, snapshots)
+	if err != nil {
+		return ir.n, err
+	}
+	var used int64
+	live.ascend(func(n *inode) bool {
+		used += n.data.size
+		return true
+	})
+
+	root := live.get(0)
+	if root == nil || !root.dir {
+		return ir.n, fmt.Errorf("image has no root directory")
+	}
+
+	if fs.tree == nil {
+		fs.tree = &tree{}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.root, fs.wd = root, root
+	fs.inodes = live
+	fs.snapshots = snapshots
+	fs.gen = gen
+	fs.ids = sb.Ids
+	fs.blksize = blksize
+	fs.capacity = sb.Capacity
+	fs.maxInodes = int(sb.MaxInodes)
+	fs.used = used
+	fs.seq = sb.Seq
+	fs.opened = fdTable{}
+	fs.umask = defaultUmask
+	return ir.n, nil
+}
+
+// generations numbers snapshots from the oldest one and gives the live
+// tree the next number. Inodes and extents get the number of the oldest
+// tree referencing them, so the newer ones copy them on change.
+// Returns the number of the live tree
+func generations(nodes []*inode, live *itable, snapshots []*snapshot) (uint64, error) {
+	gen := uint64(len(snapshots))
+	seen := make(map[*inode]bool)
+	mark := func(t *itable, gen uint64) {
+		t.ascend(func(n *inode) bool {
+			if !seen[n] {
+				seen[n] = true
+				n.gen = gen
+			}
+			return true
+		})
+	}
+	for _, s := range snapshots {
+		mark(&s.inodes, s.gen)
+	}
+	mark(live, gen)
+
+	extents := make(map[*extent]bool)
+	for _, n := range nodes {
+		if !seen[n] {
+			return 0, ErrImageFormat
+		}
+		n.data.ascend(0, func(e *extent) bool {
+			if !extents[e] || n.gen < e.gen {
+				extents[e] = true
+				e.gen = n.gen
+			}
+			return true
+		})
+	}
+	return gen, nil
+}
+
+// allSet checks if count bits starting at bit from are set
+func allSet(bitmap []byte, from, count uint64) bool {
+	for i := from; i < from+count; i++ {
+		if bitmap[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// imageWriter - encoder of image fields, keeps the first error
+type imageWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (iw *imageWriter) bytes(p []byte) {
+	if iw.err != nil {
+		return
+	}
+	n, err := iw.w.Write(p)
+	iw.n += int64(n)
+	iw.err = err
+}
+
+func (iw *imageWriter) u8(v uint8) {
+	iw.bytes([]byte{v})
+}
+
+func (iw *imageWriter) u32(v uint32) {
+	binary.LittleEndian.PutUint32(iw.buf[:4], v)
+	iw.bytes(iw.buf[:4])
+}
+
+func (iw *imageWriter) u64(v uint64) {
+	binary.LittleEndian.PutUint64(iw.buf[:], v)
+	iw.bytes(iw.buf[:])
+}
+
+func (iw *imageWriter) str(s string) {
+	iw.u32(uint32(len(s)))
+	iw.bytes([]byte(s))
+}
+
+func (iw *imageWriter) time(t time.Time) {
+	iw.u64(uint64(t.Unix()))
+	iw.u32(uint32(t.Nanosecond()))
+}
+
+// super writes superblock followed by its checksum
+func (iw *imageWriter) super(sb *superblock) {
+	hdr := make([]byte, 0, superSize+4)
+	hdr = append(hdr, imageMagic...)
+	hdr = appendU32(hdr, sb.Version)
+	hdr = appendU32(hdr, sb.BlockSize)
+	hdr = appendU64(hdr, uint64(sb.Capacity))
+	hdr = appendU64(hdr, uint64(sb.MaxInodes))
+	hdr = appendU64(hdr, sb.Ids)
+	hdr = appendU64(hdr, sb.Inodes)
+	hdr = appendU64(hdr, sb.Blocks)
+	hdr = appendU64(hdr, sb.Seq)
+	hdr = appendU64(hdr, sb.Snapshots)
+	hdr = appendU32(hdr, crc32.ChecksumIEEE(hdr))
+	iw.bytes(hdr)
+}
+
+// inode writes record of n, first maps its extents to their first block
+func (iw *imageWriter) inode(n *inode, first map[*extent]uint64) {
+	iw.u64(n.ino)
+	iw.u32(uint32(n.mode))
+	if n.dir {
+		iw.u8(1)
+	} else {
+		iw.u8(0)
+	}
+	iw.u64(uint64(n.uid))
+	iw.u64(uint64(n.gid))
+	iw.u32(uint32(n.nlink))
+	iw.u64(uint64(n.size))
+	iw.time(n.atime)
+	iw.time(n.mtime)
+	iw.time(n.ctime)
+	iw.time(n.btime)
+	iw.u64(n.dotdot)
+	iw.str(n.target)
+
+	names := make([]string, 0, len(n.entries))
+	for name := range n.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	iw.u32(uint32(len(names)))
+	for _, name := range names {
+		iw.str(name)
+		iw.u64(n.entries[name])
+	}
+
+	var runs []*extent
+	n.data.ascend(0, func(e *extent) bool {
+		runs = append(runs, e)
+		return true
+	})
+	iw.u32(uint32(len(runs)))
+	for _, e := range runs {
+		iw.u64(uint64(e.off))
+		iw.u64(uint64(len(e.data)))
+		iw.u64(first[e])
+	}
+}
+
+// table writes indices of inode records of a tree
+func (iw *imageWriter) table(refs []uint64) {
+	iw.u64(uint64(len(refs)))
+	for _, i := range refs {
+		iw.u64(i)
+	}
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendU64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// imageReader - decoder of image fields, keeps the first error
+type imageReader struct {
+	r   *bufio.Reader
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (ir *imageReader) fail(err error) {
+	if ir.err == nil {
+		ir.err = err
+	}
+}
+
+// full reads exactly len(p) bytes, a short image is a format error
+func (ir *imageReader) full(p []byte) {
+	if ir.err != nil {
+		return
+	}
+	n, err := io.ReadFull(ir.r, p)
+	ir.n += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrImageFormat
+	}
+	ir.err = err
+}
+
+func (ir *imageReader) u8() uint8 {
+	ir.full(ir.buf[:1])
+	return ir.buf[0]
+}
+
+func (ir *imageReader) u32() uint32 {
+	ir.full(ir.buf[:4])
+	return binary.LittleEndian.Uint32(ir.buf[:4])
+}
+
+func (ir *imageReader) u64() uint64 {
+	ir.full(ir.buf[:])
+	return binary.LittleEndian.Uint64(ir.buf[:])
+}
+
+// str reads length prefixed string, limit guards against damaged lengths
+func (ir *imageReader) str() string {
+	size := ir.u32()
+	if size > 1<<20 {
+		ir.fail(ErrImageFormat)
+	}
+	if ir.err != nil {
+		return ""
+	}
+	p := make([]byte, size)
+	ir.full(p)
+	return string(p)
+}
+
+func (ir *imageReader) time() time.Time {
+	sec := int64(ir.u64())
+	nsec := int64(ir.u32())
+	return time.Unix(sec, nsec)
+}
+
+// super reads and verifies superblock
+func (ir *imageReader) super() *superblock {
+	// magic and version tell the superblock size
+	hdr := make([]byte, 12, superSize+4)
+	ir.full(hdr)
+	if ir.err != nil {
+		return nil
+	}
+	if !isImage(hdr[:len(imageMagic)]) {
+		ir.fail(ErrImageFormat)
+		return nil
+	}
+
+	le := binary.LittleEndian
+	if le.Uint32(hdr[8:]) > imageVersion {
+		ir.fail(ErrImageVersion)
+		return nil
+	}
+	size := superSize
+	switch le.Uint32(hdr[8:]) {
+	case 1:
+		size = superSizeV1
+	case 2:
+		size = superSizeV2
+	}
+
+	hdr = hdr[:size+4]
+	ir.full(hdr[12:])
+	if ir.err != nil {
+		return nil
+	}
+	if crc32.ChecksumIEEE(hdr[:size]) != le.Uint32(hdr[size:]) {
+		ir.fail(ErrImageFormat)
+		return nil
+	}
+
+	sb := &superblock{
+		Version:   le.Uint32(hdr[8:]),
+		BlockSize: le.Uint32(hdr[12:]),
+		Capacity:  int64(le.Uint64(hdr[16:])),
+		MaxInodes: int64(le.Uint64(hdr[24:])),
+		Ids:       le.Uint64(hdr[32:]),
+		Inodes:    le.Uint64(hdr[40:]),
+		Blocks:    le.Uint64(hdr[48:]),
+	}
+	if sb.Version > 1 {
+		sb.Seq = le.Uint64(hdr[56:])
+	}
+	if sb.Version > 2 {
+		sb.Snapshots = le.Uint64(hdr[64:])
+	}
+	return sb
+}
+
+// imageExtents - extents of the inode records by their first block
+type imageExtents struct {
+	first map[uint64]*extent
+	// extents in order of the data region, next is the block
+	// following them and blocks the size of the region
+	order  []*extent
+	next   uint64
+	blocks uint64
+}
+
+// inode reads inode record, extents get buffers to be filled from
+// the data region unless they were read with an earlier record
+func (ir *imageReader) inode(blksize int, ext *imageExtents) *inode {
+	n := &inode{blksize: blksize}
+	n.ino = ir.u64()
+	n.mode = os.FileMode(ir.u32())
+	n.dir = ir.u8() != 0
+	n.uid = int(ir.u64())
+	n.gid = int(ir.u64())
+	n.nlink = int(ir.u32())
+	n.size = int64(ir.u64())
+	n.atime = ir.time()
+	n.mtime = ir.time()
+	n.ctime = ir.time()
+	n.btime = ir.time()
+	n.dotdot = ir.u64()
+	n.target = ir.str()
+
+	count := ir.u32()
+	if n.dir {
+		n.entries = make(map[string]uint64)
+	}
+	for i := uint32(0); i < count && ir.err == nil; i++ {
+		name := ir.str()
+		ino := ir.u64()
+		if !n.dir {
+			ir.fail(ErrImageFormat)
+		}
+		if ir.err == nil {
+			n.entries[name] = ino
+		}
+	}
+
+	count = ir.u32()
+	end := int64(-1)
+	for i := uint32(0); i < count && ir.err == nil; i++ {
+		off := int64(ir.u64())
+		size := ir.u64()
+		first := ir.u64()
+		// extents are ordered, block aligned and don't overlap
+		if off < end || off%int64(blksize) != 0 || size == 0 || size%uint64(blksize) != 0 {
+			ir.fail(ErrImageFormat)
+		}
+		if ir.err != nil {
+			break
+		}
+
+		// a new extent takes the next blocks, a shared one is the same
+		e := ext.first[first]
+		count := size / uint64(blksize)
+		switch {
+		case first < ext.next && e != nil:
+			if e.off != off || uint64(len(e.data)) != size {
+				ir.fail(ErrImageFormat)
+			}
+		case first == ext.next && count <= ext.blocks-ext.next:
+			e = &extent{off: off, data: make([]byte, size)}
+			ext.first[first] = e
+			ext.order = append(ext.order, e)
+			ext.next += count
+		default:
+			ir.fail(ErrImageFormat)
+		}
+		if ir.err != nil {
+			break
+		}
+
+		n.data.insert(e)
+		end = e.end()
+	}
+	return n
+}
+
+// table reads indices of inode records of a tree
+func (ir *imageReader) table(nodes []*inode) itable {
+	var t itable
+	count := ir.u64()
+	for i := uint64(0); i < count && ir.err == nil; i++ {
+		ir.add(&t, nodes, ir.u64())
+	}
+	return t
+}
+
+// add puts i-th inode record to the tree, an inode number is used once
+func (ir *imageReader) add(t *itable, nodes []*inode, i uint64) {
+	if ir.err != nil {
+		return
+	}
+	if i >= uint64(len(nodes)) || t.get(nodes[i].ino) != nil {
+		ir.fail(ErrImageFormat)
+		return
+	}
+	t.set(nodes[i].ino, nodes[i])
+}
@@ -0,0 +1,236 @@
+package memfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inode - file data and metadata shared by all links to the file.
+// data holds allocated extents, ranges between them are holes.
+// mu guards data, size and timestamps, the rest is guarded by the tree lock
+type inode struct {
+	mu sync.RWMutex
+
+	ino   uint64
+	dir   bool
+	mode  os.FileMode
+	uid   int
+	gid   int
+	nlink int
+	size  int64
+	data  extentTree
+
+	// size of data blocks in bytes
+	blksize int
+
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+	btime time.Time
+
+	// directories only: entry names mapped to inode numbers
+	// and inode number of the parent directory
+	entries map[string]uint64
+	dotdot  uint64
+
+	// symlinks only: path the link points to
+	target string
+
+	// count of handles referring to the inode
+	opened int
+
+	// generation of the last change and frozen versions seen by
+	// older snapshots, the newest one last
+	gen     uint64
+	history []*inode
+}
+
+// ID of the inode
+func (n *inode) ID() uint64 {
+	return n.ino
+}
+
+// IsDir - check if dir
+func (n *inode) IsDir() bool {
+	return n.dir
+}
+
+// Mode - to implemet interface
+func (n *inode) Mode() os.FileMode {
+	if n.dir {
+		return n.mode | os.ModeDir
+	}
+	return n.mode
+}
+
+// symlink - check if symbolic link
+func (n *inode) symlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+// entry name of the child inode ino
+func (n *inode) entry(ino uint64) (string, bool) {
+	for name, child := range n.entries {
+		if child == ino {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// alloc registers a new inode in the inode table
+func (fs *MemFS) alloc(n *inode) *inode {
+	n.ino = fs.nextIno()
+	n.blksize = fs.blksize
+	n.gen = fs.gen
+	now := fs.now()
+	n.atime, n.mtime, n.ctime, n.btime = now, now, now, now
+	if n.dir {
+		n.entries = make(map[string]uint64)
+	}
+	fs.inodes.set(n.ino, n)
+	return n
+}
+
+// nextIno returns next free inode number
+func (fs *MemFS) nextIno() uint64 {
+	return atomic.AddUint64(&fs.ids, 1)
+}
+
+// child returns inode of the parent's entry name
+func (fs *MemFS) child(parent *inode, name string) *inode {
+	ino, ok := parent.entries[name]
+	if !ok {
+		return nil
+	}
+	return fs.inode(ino)
+}
+
+// link adds entry name to parent pointing to n
+func (fs *MemFS) link(parent *inode, name string, n *inode) {
+	fs.cow(parent)
+	fs.cow(n)
+	parent.entries[name] = n.ino
+	n.nlink++
+	if n.dir {
+		// ".." of the new directory links to its parent
+		n.dotdot = parent.ino
+		n.nlink++
+		parent.nlink++
+	}
+
+	fs.modified(parent)
+	fs.changed(n)
+}
+
+// unlink removes entry name from parent and frees its inode if unused
+func (fs *MemFS) unlink(parent *inode, name string) {
+	n := fs.child(parent, name)
+	fs.cow(parent)
+	delete(parent.entries, name)
+	fs.modified(parent)
+	if n == nil {
+		return
+	}
+
+	fs.cow(n)
+	n.nlink--
+	if n.dir {
+		n.nlink--
+		parent.nlink--
+	}
+	fs.changed(n)
+	fs.release(n)
+}
+
+// release frees inode once it has no links and no open handles
+func (fs *MemFS) release(n *inode) {
+	if n.nlink > 0 || n.opened > 0 {
+		return
+	}
+
+	fs.cow(n)
+	count := n.Blocks()
+	n.data = extentTree{}
+	fs.reclaim(n, count)
+	fs.inodes.delete(n.ino)
+}
+
+// contains checks if dir is ancestor of n or n itself
+func (fs *MemFS) contains(dir, n *inode) bool {
+	for {
+		if n == dir {
+			return true
+		}
+		if n == fs.root {
+			return false
+		}
+		n = fs.inode(n.dotdot)
+	}
+}
+
+// renamed points views of open handles at the new entry name
+func (fs *MemFS) renamed(oldParent *inode, oldName string, newParent *inode, newName string) {
+	for _, h := range fs.opened.handles {
+		if h != nil && h.file.parent == oldParent && h.file.name == oldName {
+			h.file.parent, h.file.name = newParent, newName
+		}
+	}
+}
+
+// path - absolute path of the directory inode
+func (fs *MemFS) path(dir *inode) string {
+	if dir == fs.root {
+		return "/"
+	}
+
+	parent := fs.inode(dir.dotdot)
+	name, _ := parent.entry(dir.ino)
+	return filepath.Join(fs.path(parent), name)
+}
+
+// view makes File for the entry name of parent
+func (fs *MemFS) view(parent *inode, name string, n *inode) *File {
+	return &File{inode: n, name: name, parent: parent, fs: fs}
+}
+
+// dirView makes File for the directory inode
+func (fs *MemFS) dirView(dir *inode) *File {
+	if dir == fs.root {
+		return fs.view(nil, "/", dir)
+	}
+
+	parent := fs.inode(dir.dotdot)
+	name, _ := parent.entry(dir.ino)
+	return fs.view(parent, name, dir)
+}
+
+// find makes File for the first link to inode ino
+func (fs *MemFS) find(ino uint64) *File {
+	n := fs.inode(ino)
+	if n == nil {
+		return nil
+	}
+	if n.dir {
+		return fs.dirView(n)
+	}
+
+	var walk func(dir *inode) *File
+	walk = func(dir *inode) *File {
+		for name, child := range dir.entries {
+			if child == ino {
+				return fs.view(dir, name, n)
+			}
+			if sub := fs.inode(child); sub.dir {
+				if f := walk(sub); f != nil {
+					return f
+				}
+			}
+		}
+		return nil
+	}
+	return walk(fs.root)
+}
@@ -0,0 +1,240 @@
+package memfs
+
+import (
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+)
+
+// IOFS adapts MemFS to the standard library io/fs interfaces
+type IOFS struct {
+	fs *MemFS
+}
+
+var (
+	_ iofs.FS          = (*IOFS)(nil)
+	_ iofs.ReadDirFS   = (*IOFS)(nil)
+	_ iofs.StatFS      = (*IOFS)(nil)
+	_ iofs.GlobFS      = (*IOFS)(nil)
+	_ iofs.ReadDirFile = (*ioDir)(nil)
+)
+
+// IOFS returns io/fs view of the filesystem rooted at "/"
+func (fs *MemFS) IOFS() *IOFS {
+	return &IOFS{fs: fs}
+}
+
+// lookup resolves an io/fs path to a file, the last
+// path element is followed if it is a symlink and follow is set.
+// Caller holds the tree lock
+func (s *IOFS) lookup(op, name string, follow bool) (*File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+
+	resolve := s.fs.file
+	if follow {
+		resolve = s.fs.follow
+	}
+	_, f, err := resolve("/" + name)
+	if err != nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+	if f == nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// Open opens the named file for reading
+func (s *IOFS) Open(name string) (iofs.File, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+
+	f, err := s.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.fs.access(f.inode, mayRead) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrPermission}
+	}
+
+	base := path.Base(name)
+	if f.dir {
+		return &ioDir{info: s.fs.info(base, f.inode), entries: s.fs.readDir(f.inode)}, nil
+	}
+	return &ioFile{file: f, name: base}, nil
+}
+
+// Stat returns a FileInfo describing the named file
+func (s *IOFS) Stat(name string) (iofs.FileInfo, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+
+	f, err := s.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.info(path.Base(name), f.inode), nil
+}
+
+// Lstat is like Stat but describes the symlink itself
+func (s *IOFS) Lstat(name string) (iofs.FileInfo, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+
+	f, err := s.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.info(path.Base(name), f.inode), nil
+}
+
+// ReadLink returns the destination of the named symbolic link
+func (s *IOFS) ReadLink(name string) (string, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+
+	f, err := s.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !f.symlink() {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: iofs.ErrInvalid}
+	}
+	return f.target, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name
+func (s *IOFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+
+	f, err := s.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !f.dir {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+	if !s.fs.access(f.inode, mayRead) {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrPermission}
+	}
+	return s.fs.readDir(f.inode), nil
+}
+
+// Glob returns the names of all files matching pattern
+func (s *IOFS) Glob(pattern string) ([]string, error) {
+	// hide Glob method so io/fs falls back to its ReadDir based matching
+	return iofs.Glob(struct{ iofs.ReadDirFS }{s}, pattern)
+}
+
+// readDir lists entries of dir, caller holds the tree lock
+func (fs *MemFS) readDir(dir *inode) []iofs.DirEntry {
+	entries := make([]iofs.DirEntry, 0, len(dir.entries))
+	for name := range dir.entries {
+		info := fs.info(name, fs.child(dir, name))
+		entries = append(entries, iofs.FileInfoToDirEntry(info))
+	}
+	fs.accessed(dir)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// ioFile - regular file opened through IOFS
+type ioFile struct {
+	file   *File
+	name   string
+	off    int64
+	closed bool
+}
+
+// Stat returns file stats
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	if f.closed {
+		return nil, &iofs.PathError{Op: "stat", Path: f.name, Err: iofs.ErrClosed}
+	}
+
+	// report stats under the name the file was opened with
+	info := f.file.stat()
+	info.name = f.name
+	return info, nil
+}
+
+// Read reads up to len(p) bytes from current offset
+func (f *ioFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &iofs.PathError{Op: "read", Path: f.name, Err: iofs.ErrClosed}
+	}
+
+	n, err := f.file.ReadAt(p, int(f.off))
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close the file
+func (f *ioFile) Close() error {
+	if f.closed {
+		return &iofs.PathError{Op: "close", Path: f.name, Err: iofs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// ioDir - directory opened through IOFS
+type ioDir struct {
+	info    *fileInfo
+	entries []iofs.DirEntry
+	off     int
+	closed  bool
+}
+
+// Stat returns directory stats
+func (d *ioDir) Stat() (iofs.FileInfo, error) {
+	if d.closed {
+		return nil, &iofs.PathError{Op: "stat", Path: d.info.name, Err: iofs.ErrClosed}
+	}
+	return d.info, nil
+}
+
+// Read - directories can't be read as a byte stream
+func (d *ioDir) Read(p []byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: ErrIsDir}
+}
+
+// ReadDir returns the next n directory entries, or all remaining if n <= 0
+func (d *ioDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if d.closed {
+		return nil, &iofs.PathError{Op: "readdir", Path: d.info.name, Err: iofs.ErrClosed}
+	}
+
+	left := d.entries[d.off:]
+	if n <= 0 {
+		d.off = len(d.entries)
+		return left, nil
+	}
+	if len(left) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(left) {
+		n = len(left)
+	}
+	d.off += n
+	return left[:n], nil
+}
+
+// Close the directory
+func (d *ioDir) Close() error {
+	if d.closed {
+		return &iofs.PathError{Op: "close", Path: d.info.name, Err: iofs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,66 @@
+package memfs_test
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"fs/memfs"
+)
+
+// writeFile creates name with data, replacing its content if it exists
+func writeFile(t testing.TB, fs *memfs.MemFS, name, data string) {
+	t.Helper()
+	h, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// populate fills fs with nested directories, files and symlinks
+func populate(t testing.TB, fs *memfs.MemFS) {
+	t.Helper()
+	for _, dir := range []string{"/a/b/c", "/a/empty", "/d"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, fs, "/top.txt", "top")
+	writeFile(t, fs, "/a/one", "1")
+	writeFile(t, fs, "/a/b/two", "22")
+	writeFile(t, fs, "/a/b/c/three", "333")
+	writeFile(t, fs, "/d/empty", "")
+	for _, l := range [][2]string{
+		{"b/two", "/a/rel"},
+		{"/a/b/c", "/d/abs"},
+		{"../top.txt", "/d/up"},
+	} {
+		if err := fs.Symlink(l[0], l[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIOFS(t *testing.T) {
+	fs := memfs.Create()
+	populate(t, fs)
+
+	err := fstest.TestFS(fs.IOFS(),
+		"top.txt", "a/one", "a/b/two", "a/b/c/three", "a/empty", "d/empty",
+		"a/rel", "d/abs", "d/up")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOFSEmpty(t *testing.T) {
+	if err := fstest.TestFS(memfs.Create().IOFS()); err != nil {
+		t.Fatal(err)
+	}
+}
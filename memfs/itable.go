@@ -0,0 +1,149 @@
+package memfs
+
+import "sync/atomic"
+
+// fanout of inode table nodes
+const (
+	tableBits = 4
+	tableFan  = 1 << tableBits
+)
+
+// owners hands out owner tokens of inode tables
+var owners uint64
+
+// itable - inode table, a radix tree on inode numbers. A fork of the table
+// shares all nodes with it, a node is copied before its first change by
+// a table that doesn't own it. So forking costs O(1) and a change O(log n)
+type itable struct {
+	root  *tnode
+	owner uint64
+	// levels below the root
+	depth int
+	count int
+}
+
+// tnode - node of the inode table, leaves hold inodes
+type tnode struct {
+	owner uint64
+	kids  []*tnode
+	nodes []*inode
+}
+
+func newOwner() uint64 {
+	return atomic.AddUint64(&owners, 1)
+}
+
+// fork makes a copy of the table, both of them copy shared nodes on change
+func (t *itable) fork() itable {
+	c := *t
+	c.owner = newOwner()
+	t.owner = newOwner()
+	return c
+}
+
+// len - count of inodes in the table
+func (t *itable) len() int {
+	return t.count
+}
+
+// get finds inode ino
+func (t *itable) get(ino uint64) *inode {
+	if t.root == nil || ino>>(tableBits*(uint(t.depth)+1)) != 0 {
+		return nil
+	}
+
+	node := t.root
+	for level := t.depth; level > 0; level-- {
+		node = node.kids[ino>>(tableBits*uint(level))%tableFan]
+		if node == nil {
+			return nil
+		}
+	}
+	return node.nodes[ino%tableFan]
+}
+
+// set puts n as inode ino, nil n deletes it
+func (t *itable) set(ino uint64, n *inode) {
+	if t.root == nil {
+		if n == nil {
+			return
+		}
+		t.root = t.node(0)
+	}
+	for ino>>(tableBits*(uint(t.depth)+1)) != 0 {
+		if n == nil {
+			return
+		}
+		root := t.node(t.depth + 1)
+		root.kids[0] = t.root
+		t.root = root
+		t.depth++
+	}
+
+	node := t.own(&t.root, t.depth)
+	for level := t.depth; level > 0; level-- {
+		node = t.own(&node.kids[ino>>(tableBits*uint(level))%tableFan], level-1)
+	}
+
+	slot := &node.nodes[ino%tableFan]
+	switch {
+	case *slot == nil && n != nil:
+		t.count++
+	case *slot != nil && n == nil:
+		t.count--
+	}
+	*slot = n
+}
+
+// delete removes inode ino
+func (t *itable) delete(ino uint64) {
+	t.set(ino, nil)
+}
+
+// node makes a node at level owned by the table
+func (t *itable) node(level int) *tnode {
+	if level == 0 {
+		return &tnode{owner: t.owner, nodes: make([]*inode, tableFan)}
+	}
+	return &tnode{owner: t.owner, kids: make([]*tnode, tableFan)}
+}
+
+// own makes node at *slot owned by the table, copying or creating it
+func (t *itable) own(slot **tnode, level int) *tnode {
+	node := *slot
+	switch {
+	case node == nil:
+		node = t.node(level)
+	case node.owner != t.owner:
+		c := &tnode{owner: t.owner}
+		c.kids = append(c.kids, node.kids...)
+		c.nodes = append(c.nodes, node.nodes...)
+		node = c
+	default:
+		return node
+	}
+	*slot = node
+	return node
+}
+
+// ascend calls fn for inodes in inode number order until fn returns false
+func (t *itable) ascend(fn func(n *inode) bool) {
+	var walk func(node *tnode) bool
+	walk = func(node *tnode) bool {
+		if node == nil {
+			return true
+		}
+		for _, kid := range node.kids {
+			if !walk(kid) {
+				return false
+			}
+		}
+		for _, n := range node.nodes {
+			if n != nil && !fn(n) {
+				return false
+			}
+		}
+		return true
+	}
+	walk(t.root)
+}
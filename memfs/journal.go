@@ -0,0 +1,487 @@
+package memfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal layout, all numbers are little endian:
+//
+//	header  magic, version
+//	records length and crc32 of the payload followed by the payload
+//
+// Each record holds one complete change and is applied on Load
+// if it is newer than the image. Replay stops at the first record
+// that is cut short or fails the checksum, it was never committed
+const (
+	journalMagic   = "MEMFSJNL"
+	journalVersion = 1
+
+	journalHeader = len(journalMagic) + 4
+)
+
+// journaled changes
+const (
+	opMknod uint8 = iota + 1
+	opLink
+	opUnlink
+	opRename
+	opAttr
+	opWrite
+	opTruncate
+	opPunch
+	opSnapshot
+	opRestore
+)
+
+var (
+	// ErrJournal - journal doesn't apply to the image it is next to
+	ErrJournal = errors.New("journal doesn't match image")
+	// ErrNotMounted - filesystem wasn't mounted from an image
+	ErrNotMounted = errors.New("filesystem isn't mounted")
+)
+
+// journal - append only log of changes next to the image
+type journal struct {
+	mu    sync.Mutex
+	f     *os.File
+	image string
+	// first failed append, records aren't written after it
+	err error
+}
+
+// record - journaled change. Fields used depend on the op
+type record struct {
+	seq  uint64
+	op   uint8
+	time time.Time
+
+	// entry name of parent, rename moves it to newName of newParent
+	parent    uint64
+	name      string
+	newParent uint64
+	newName   string
+
+	// inode and its attributes
+	ino    uint64
+	mode   os.FileMode
+	uid    int
+	gid    int
+	target string
+	atime  time.Time
+	mtime  time.Time
+
+	// data range
+	off  int64
+	size int64
+	data []byte
+}
+
+// journalPath - path of the journal of the image at path
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// log appends r to the journal if there is one. Caller holds the tree lock
+// exclusively or together with the lock of the inode r changes, so records
+// of dependent changes are appended in order
+func (fs *MemFS) log(r *record) {
+	j := fs.journal
+	if j == nil {
+		return
+	}
+	if r.time.IsZero() {
+		r.time = fs.now()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fs.seq++
+	r.seq = fs.seq
+	if j.err != nil {
+		return
+	}
+
+	payload := r.encode()
+	buf := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	_, j.err = j.f.Write(append(buf, payload...))
+}
+
+// logAttr journals attributes of n changed by chmod, chown or chtimes
+func (fs *MemFS) logAttr(n *inode) {
+	fs.log(&record{
+		op:    opAttr,
+		ino:   n.ino,
+		mode:  n.Mode(),
+		uid:   n.uid,
+		gid:   n.gid,
+		atime: n.atime,
+		mtime: n.mtime,
+		time:  n.ctime,
+	})
+}
+
+// encode makes payload of the record
+func (r *record) encode() []byte {
+	var buf bytes.Buffer
+	iw := &imageWriter{w: bufio.NewWriter(&buf)}
+
+	iw.u64(r.seq)
+	iw.u8(r.op)
+	iw.time(r.time)
+	iw.u64(r.parent)
+	iw.str(r.name)
+	iw.u64(r.newParent)
+	iw.str(r.newName)
+	iw.u64(r.ino)
+	iw.u32(uint32(r.mode))
+	iw.u64(uint64(r.uid))
+	iw.u64(uint64(r.gid))
+	iw.str(r.target)
+	iw.time(r.atime)
+	iw.time(r.mtime)
+	iw.u64(uint64(r.off))
+	iw.u64(uint64(r.size))
+	iw.u64(uint64(len(r.data)))
+	iw.bytes(r.data)
+
+	iw.w.Flush()
+	return buf.Bytes()
+}
+
+// decodeRecord parses record payload
+func decodeRecord(p []byte) (*record, error) {
+	ir := &imageReader{r: bufio.NewReader(bytes.NewReader(p))}
+	r := &record{}
+
+	r.seq = ir.u64()
+	r.op = ir.u8()
+	r.time = ir.time()
+	r.parent = ir.u64()
+	r.name = ir.str()
+	r.newParent = ir.u64()
+	r.newName = ir.str()
+	r.ino = ir.u64()
+	r.mode = os.FileMode(ir.u32())
+	r.uid = int(ir.u64())
+	r.gid = int(ir.u64())
+	r.target = ir.str()
+	r.atime = ir.time()
+	r.mtime = ir.time()
+	r.off = int64(ir.u64())
+	r.size = int64(ir.u64())
+
+	size := ir.u64()
+	if size > uint64(len(p)) {
+		ir.fail(ErrImageFormat)
+	}
+	if ir.err != nil {
+		return nil, ir.err
+	}
+	r.data = make([]byte, size)
+	ir.full(r.data)
+	return r, ir.err
+}
+
+// replay applies records of the journal at path newer than the image.
+// Returns length of the journal up to the last intact record, 0 if even
+// the header is missing
+func (fs *MemFS) replay(path string) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	hdr := make([]byte, journalHeader)
+	if _, err := io.ReadFull(r, hdr); err != nil || string(hdr[:len(journalMagic)]) != journalMagic {
+		return 0, nil
+	}
+	if binary.LittleEndian.Uint32(hdr[len(journalMagic):]) > journalVersion {
+		return 0, ErrImageVersion
+	}
+
+	// records are applied with their own times
+	clock := fs.clock
+	defer func() { fs.clock = clock }()
+
+	valid := int64(journalHeader)
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(head[:]))
+		if valid+8+size > st.Size() {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(head[4:]) {
+			break
+		}
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+
+		// records folded into the image already are skipped
+		if rec.seq > fs.seq {
+			if rec.seq != fs.seq+1 {
+				return valid, ErrJournal
+			}
+			fs.clock = func() time.Time { return rec.time }
+			if err := fs.apply(rec); err != nil {
+				return valid, fmt.Errorf("journal record %d: %v", rec.seq, err)
+			}
+			fs.seq = rec.seq
+		}
+		valid += 8 + size
+	}
+	return valid, nil
+}
+
+// apply redoes the journaled change, no access checks are made
+func (fs *MemFS) apply(r *record) error {
+	switch r.op {
+	case opMknod, opLink, opUnlink, opRename:
+		return fs.applyEntry(r)
+	case opSnapshot:
+		if fs.snapshot(r.name) != nil {
+			return ErrJournal
+		}
+		fs.takeSnapshot(r.name)
+		return nil
+	case opRestore:
+		s := fs.snapshot(r.name)
+		if s == nil {
+			return ErrJournal
+		}
+		fs.restore(s)
+		return nil
+	}
+
+	// data of unlinked files is gone once they are closed
+	n := fs.inode(r.ino)
+	if n == nil {
+		return nil
+	}
+
+	switch r.op {
+	case opAttr:
+		fs.cow(n)
+		n.mode = r.mode &^ os.ModeDir
+		n.uid, n.gid = r.uid, r.gid
+		n.atime, n.mtime, n.ctime = r.atime, r.mtime, r.time
+		return nil
+	case opWrite:
+		_, err := fs.writeAt(n, r.data, r.off)
+		return err
+	case opTruncate:
+		return fs.truncate(n, int(r.size))
+	case opPunch:
+		return fs.punchHole(n, r.off, r.size)
+	}
+	return ErrJournal
+}
+
+// applyEntry redoes change of directory entries
+func (fs *MemFS) applyEntry(r *record) error {
+	parent := fs.inode(r.parent)
+	if parent == nil || !parent.dir {
+		return ErrJournal
+	}
+	exists := fs.child(parent, r.name) != nil
+
+	switch r.op {
+	case opMknod:
+		if exists {
+			return ErrJournal
+		}
+		// inode numbers are handed out in the journal order
+		n := fs.alloc(&inode{
+			dir:    r.mode.IsDir(),
+			mode:   r.mode &^ os.ModeDir,
+			target: r.target,
+		})
+		if n.ino != r.ino {
+			return ErrJournal
+		}
+		n.uid, n.gid = r.uid, r.gid
+		fs.link(parent, r.name, n)
+	case opLink:
+		n := fs.inode(r.ino)
+		if exists || n == nil || n.dir {
+			return ErrJournal
+		}
+		fs.link(parent, r.name, n)
+	case opUnlink:
+		if !exists {
+			return ErrJournal
+		}
+		fs.unlink(parent, r.name)
+	case opRename:
+		newParent := fs.inode(r.newParent)
+		if !exists || newParent == nil || !newParent.dir {
+			return ErrJournal
+		}
+		fs.rename(parent, r.name, newParent, r.newName)
+	}
+	return nil
+}
+
+// openJournal opens journal at path for appending after valid bytes,
+// the rest is a torn record and is cut off
+func openJournal(path, image string, valid int64) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, image: image}
+
+	if valid == 0 {
+		err = j.reset()
+	} else if err = f.Truncate(valid); err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// reset empties the journal leaving just the header
+func (j *journal) reset() error {
+	hdr := appendU32([]byte(journalMagic), journalVersion)
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	if _, err := j.f.Seek(int64(len(hdr)), io.SeekStart); err != nil {
+		return err
+	}
+	j.err = nil
+	return j.f.Sync()
+}
+
+// Mount loads the image at path replaying its journal, or creates a new
+// image with opts if there is none. Changes are journaled next to the image
+// until Unmount
+func Mount(path string, opts ...Options) (*MemFS, error) {
+	fs, valid, err := load(path)
+	if os.IsNotExist(err) {
+		fs, valid = Create(opts...), 0
+		err = Save(path, fs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := openJournal(journalPath(path), path, valid)
+	if err != nil {
+		return nil, err
+	}
+	fs.journal = j
+	return fs, nil
+}
+
+// Checkpoint saves the image and empties the journal,
+// opts set how the image is saved
+func (fs *MemFS) Checkpoint(opts ...SaveOptions) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.checkpoint(opts)
+}
+
+// checkpoint - caller holds the tree lock exclusively
+func (fs *MemFS) checkpoint(opts []SaveOptions) error {
+	j := fs.journal
+	if j == nil {
+		return ErrNotMounted
+	}
+
+	var o SaveOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	// the image records the last journaled change, so replay skips
+	// the records if the journal isn't emptied due to a crash
+	err := writeFile(j.image, o.Backups, func(w io.Writer) error {
+		_, err := fs.writeImage(w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.reset()
+}
+
+// Sync flushes the journal to stable storage,
+// error of a failed append is reported until the next checkpoint
+func (fs *MemFS) Sync() error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	j := fs.journal
+	if j == nil {
+		return ErrNotMounted
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	return j.f.Sync()
+}
+
+// Unmount saves the image and removes the journal,
+// filesystem stays mounted if the image isn't saved
+func (fs *MemFS) Unmount(opts ...SaveOptions) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkpoint(opts); err != nil {
+		return err
+	}
+
+	j := fs.journal
+	fs.journal = nil
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.f.Name())
+}
@@ -0,0 +1,360 @@
+package memfs
+
+import (
+	"math"
+	"sync"
+	"syscall"
+)
+
+// LockType - kind of advisory lock
+type LockType int
+
+const (
+	// Unlock - release the lock
+	Unlock LockType = iota
+	// SharedLock - read lock, many handles may hold it at once
+	SharedLock
+	// ExclusiveLock - write lock, no other handle may hold a lock with it
+	ExclusiveLock
+)
+
+// RangeLock - byte-range lock of a file
+type RangeLock struct {
+	Type LockType
+	// Off and Len of the range, Len 0 means up to any size of the file
+	Off int64
+	Len int64
+	// Fd of the handle holding the lock
+	Fd int
+}
+
+// lockTable - advisory locks by inode number and requests of handles
+// blocked waiting for a lock. Locks are owned by handles: locks of the
+// same handle never conflict with each other and Close releases them
+type lockTable struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	files   map[uint64]*fileLocks
+	waiters map[*lockRequest]*Handle
+}
+
+// fileLocks - locks of an inode, flock locks are independent from byte-range ones
+type fileLocks struct {
+	flocks map[*Handle]LockType
+	ranges []*byteRange
+}
+
+// byteRange - range [start, end) locked by owner
+type byteRange struct {
+	owner      *Handle
+	typ        LockType
+	start, end int64
+}
+
+// lockRequest - flock or byte-range lock asked for
+type lockRequest struct {
+	ino        uint64
+	flock      bool
+	typ        LockType
+	start, end int64
+}
+
+// Flock places whole-file lock like flock(2), Unlock releases it. A lock
+// the handle holds is converted in place, so two handles upgrading shared
+// locks at once deadlock and one of them fails with EDEADLK.
+// Without wait a conflicting lock fails with EAGAIN
+func (h *Handle) Flock(typ LockType, wait bool) error {
+	if err := h.lockable("flock", typ); err != nil {
+		return err
+	}
+
+	r := &lockRequest{ino: h.file.ino, flock: true, typ: typ}
+	if err := h.fs.locks.acquire(h, r, wait); err != nil {
+		return h.error("flock", err)
+	}
+	return nil
+}
+
+// LockRange places byte-range lock of [off, off+length) like fcntl(2)
+// F_SETLK, or F_SETLKW if wait is set. Length 0 locks up to any size the
+// file grows to, negative length locks the range ending at off. Shared
+// locks need a readable handle and exclusive ones a writable handle.
+// Waiting for a lock held by a handle which waits for one of this handle
+// fails with EDEADLK
+func (h *Handle) LockRange(typ LockType, off, length int64, wait bool) error {
+	if err := h.lockable("lock", typ); err != nil {
+		return err
+	}
+	h.mu.RLock()
+	flag := h.readable() && typ == SharedLock || h.writable() && typ == ExclusiveLock
+	h.mu.RUnlock()
+	if typ != Unlock && !flag {
+		return h.error("lock", ErrBadFd)
+	}
+
+	start, end, err := lockRange(off, length)
+	if err != nil {
+		return h.error("lock", err)
+	}
+	r := &lockRequest{ino: h.file.ino, typ: typ, start: start, end: end}
+	if err := h.fs.locks.acquire(h, r, wait); err != nil {
+		return h.error("lock", err)
+	}
+	return nil
+}
+
+// TestRange returns a lock of another handle which keeps typ lock of
+// [off, off+length) from being placed like fcntl(2) F_GETLK,
+// nil if there is none
+func (h *Handle) TestRange(typ LockType, off, length int64) (*RangeLock, error) {
+	if err := h.lockable("testlock", typ); err != nil {
+		return nil, err
+	}
+	start, end, err := lockRange(off, length)
+	if err != nil {
+		return nil, h.error("testlock", err)
+	}
+
+	t := &h.fs.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	br := t.conflict(h, &lockRequest{ino: h.file.ino, typ: typ, start: start, end: end})
+	if br == nil {
+		return nil, nil
+	}
+	l := &RangeLock{Type: br.typ, Off: br.start, Fd: br.owner.fd}
+	if br.end != math.MaxInt64 {
+		l.Len = br.end - br.start
+	}
+	return l, nil
+}
+
+// lockable checks that h is open and typ is valid
+func (h *Handle) lockable(op string, typ LockType) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return h.error(op, ErrBadFd)
+	}
+	if typ < Unlock || typ > ExclusiveLock {
+		return h.error(op, syscall.EINVAL)
+	}
+	return nil
+}
+
+// lockRange converts off and length of a range to its bounds
+func lockRange(off, length int64) (int64, int64, error) {
+	if length < 0 {
+		off, length = off+length, -length
+	}
+	if off < 0 {
+		return 0, 0, syscall.EINVAL
+	}
+	if length == 0 {
+		return off, math.MaxInt64, nil
+	}
+	if length > math.MaxInt64-off {
+		return 0, 0, syscall.EINVAL
+	}
+	return off, off + length, nil
+}
+
+// init makes maps of the table, caller holds t.mu
+func (t *lockTable) init() {
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mu)
+		t.files = make(map[uint64]*fileLocks)
+		t.waiters = make(map[*lockRequest]*Handle)
+	}
+}
+
+// acquire places lock r of h or releases it for Unlock,
+// waiting for conflicting locks to go away if wait is set
+func (t *lockTable) acquire(h *Handle, r *lockRequest, wait bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+
+	for {
+		// locks of a closed handle were released and can't be placed again
+		if h.unlocked {
+			return ErrBadFd
+		}
+		if r.typ == Unlock || t.conflict(h, r) == nil {
+			t.place(h, r)
+			return nil
+		}
+		if !wait {
+			return syscall.EAGAIN
+		}
+		if t.deadlock(h, r) {
+			return syscall.EDEADLK
+		}
+
+		t.waiters[r] = h
+		t.cond.Wait()
+		delete(t.waiters, r)
+	}
+}
+
+// conflict returns a lock of another handle r conflicts with, nil if there
+// is none. A flock conflict is returned as a range of the whole file
+func (t *lockTable) conflict(h *Handle, r *lockRequest) *byteRange {
+	fl := t.files[r.ino]
+	if fl == nil || r.typ == Unlock {
+		return nil
+	}
+
+	if r.flock {
+		for owner, typ := range fl.flocks {
+			if owner != h && (typ == ExclusiveLock || r.typ == ExclusiveLock) {
+				return &byteRange{owner: owner, typ: typ, end: math.MaxInt64}
+			}
+		}
+		return nil
+	}
+	for _, br := range fl.ranges {
+		if br.owner != h && br.start < r.end && r.start < br.end &&
+			(br.typ == ExclusiveLock || r.typ == ExclusiveLock) {
+			return br
+		}
+	}
+	return nil
+}
+
+// blockers returns handles holding locks r of h conflicts with
+func (t *lockTable) blockers(h *Handle, r *lockRequest) []*Handle {
+	fl := t.files[r.ino]
+	if fl == nil || r.typ == Unlock {
+		return nil
+	}
+
+	var owners []*Handle
+	if r.flock {
+		for owner, typ := range fl.flocks {
+			if owner != h && (typ == ExclusiveLock || r.typ == ExclusiveLock) {
+				owners = append(owners, owner)
+			}
+		}
+		return owners
+	}
+	for _, br := range fl.ranges {
+		if br.owner != h && br.start < r.end && r.start < br.end &&
+			(br.typ == ExclusiveLock || r.typ == ExclusiveLock) {
+			owners = append(owners, br.owner)
+		}
+	}
+	return owners
+}
+
+// deadlock checks if waiting for r makes a cycle: a handle holding
+// a lock r conflicts with waits, directly or through other waiting
+// handles, for a lock h holds
+func (t *lockTable) deadlock(h *Handle, r *lockRequest) bool {
+	seen := make(map[*Handle]bool)
+	queue := t.blockers(h, r)
+	for len(queue) > 0 {
+		owner := queue[0]
+		queue = queue[1:]
+		if owner == h {
+			return true
+		}
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+
+		for wr, waiter := range t.waiters {
+			if waiter == owner {
+				queue = append(queue, t.blockers(waiter, wr)...)
+			}
+		}
+	}
+	return false
+}
+
+// place sets lock r of h replacing locks h has on the same range,
+// or removes them for Unlock. Waiters are woken if locks were released
+func (t *lockTable) place(h *Handle, r *lockRequest) {
+	fl := t.files[r.ino]
+	if fl == nil {
+		if r.typ == Unlock {
+			return
+		}
+		fl = &fileLocks{flocks: make(map[*Handle]LockType)}
+		t.files[r.ino] = fl
+	}
+
+	if r.flock {
+		if r.typ == Unlock {
+			delete(fl.flocks, h)
+		} else {
+			fl.flocks[h] = r.typ
+		}
+	} else {
+		fl.ranges = cutRanges(fl.ranges, h, r.typ, r.start, r.end)
+	}
+
+	if len(fl.flocks) == 0 && len(fl.ranges) == 0 {
+		delete(t.files, r.ino)
+	}
+	// a downgrade or unlock may let waiters in
+	t.cond.Broadcast()
+}
+
+// cutRanges places typ lock of [start, end) owned by h into ranges.
+// Ranges of h overlapping it are cut, adjacent and overlapping ones of
+// the same type are merged with it, so ranges of a handle stay disjoint
+func cutRanges(ranges []*byteRange, h *Handle, typ LockType, start, end int64) []*byteRange {
+	if typ != Unlock {
+		for _, br := range ranges {
+			if br.owner == h && br.typ == typ && br.start <= end && start <= br.end {
+				if br.start < start {
+					start = br.start
+				}
+				if br.end > end {
+					end = br.end
+				}
+			}
+		}
+	}
+
+	kept := make([]*byteRange, 0, len(ranges)+2)
+	for _, br := range ranges {
+		if br.owner != h || br.end <= start || end <= br.start {
+			kept = append(kept, br)
+			continue
+		}
+		if br.start < start {
+			kept = append(kept, &byteRange{owner: h, typ: br.typ, start: br.start, end: start})
+		}
+		if br.end > end {
+			kept = append(kept, &byteRange{owner: h, typ: br.typ, start: end, end: br.end})
+		}
+	}
+	if typ != Unlock {
+		kept = append(kept, &byteRange{owner: h, typ: typ, start: start, end: end})
+	}
+	return kept
+}
+
+// release drops all locks of h, called when h is closed
+func (t *lockTable) release(h *Handle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+
+	h.unlocked = true
+	ino := h.file.ino
+	if fl := t.files[ino]; fl != nil {
+		delete(fl.flocks, h)
+		fl.ranges = cutRanges(fl.ranges, h, Unlock, 0, math.MaxInt64)
+		if len(fl.flocks) == 0 && len(fl.ranges) == 0 {
+			delete(t.files, ino)
+		}
+	}
+	// waiters of h fail with ErrBadFd, others may get their locks
+	t.cond.Broadcast()
+}
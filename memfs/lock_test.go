@@ -0,0 +1,188 @@
+package memfs_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"fs/memfs"
+)
+
+// openLocked creates /f and opens n read-write handles of it
+func openLocked(t *testing.T, n int) (*memfs.MemFS, []*memfs.Handle) {
+	t.Helper()
+	fs := memfs.Create()
+	writeFile(t, fs, "/f", "data")
+	var hs []*memfs.Handle
+	for i := 0; i < n; i++ {
+		h, err := fs.OpenFile("/f", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		hs = append(hs, h)
+	}
+	return fs, hs
+}
+
+// blocked runs lock in the background and checks it waits
+func blocked(t *testing.T, lock func() error) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- lock() }()
+	select {
+	case err := <-done:
+		t.Fatalf("lock didn't wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	return done
+}
+
+// result waits for lock started by blocked
+func result(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock still waits")
+		return nil
+	}
+}
+
+func TestLockDeadlock(t *testing.T) {
+	tests := []struct {
+		name string
+		// hold places the first lock of handle i,
+		// want asks for the lock the other handle holds
+		hold, want func(h *memfs.Handle, i int) error
+		unlock     func(h *memfs.Handle) error
+	}{
+		{
+			name:   "flock upgrade",
+			hold:   func(h *memfs.Handle, i int) error { return h.Flock(memfs.SharedLock, false) },
+			want:   func(h *memfs.Handle, i int) error { return h.Flock(memfs.ExclusiveLock, true) },
+			unlock: func(h *memfs.Handle) error { return h.Flock(memfs.Unlock, false) },
+		},
+		{
+			name: "range cycle",
+			hold: func(h *memfs.Handle, i int) error {
+				return h.LockRange(memfs.ExclusiveLock, int64(i)*10, 10, false)
+			},
+			want: func(h *memfs.Handle, i int) error {
+				return h.LockRange(memfs.ExclusiveLock, int64(1-i)*10, 10, true)
+			},
+			unlock: func(h *memfs.Handle) error { return h.LockRange(memfs.Unlock, 0, 0, false) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, hs := openLocked(t, 2)
+			for i, h := range hs {
+				if err := tt.hold(h, i); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the first one waits for the second one,
+			// which would wait for the first one
+			done := blocked(t, func() error { return tt.want(hs[0], 0) })
+			if err := tt.want(hs[1], 1); !errors.Is(err, syscall.EDEADLK) {
+				t.Fatalf("closing the cycle: %v, want EDEADLK", err)
+			}
+
+			// the failed handle keeps its lock until it gives it up
+			if err := tt.unlock(hs[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := result(t, done); err != nil {
+				t.Fatalf("waiting lock: %v", err)
+			}
+		})
+	}
+}
+
+func TestLockReleasedOnClose(t *testing.T) {
+	_, hs := openLocked(t, 3)
+	if err := hs[0].Flock(memfs.ExclusiveLock, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := hs[0].LockRange(memfs.ExclusiveLock, 0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	flock := blocked(t, func() error { return hs[1].Flock(memfs.SharedLock, true) })
+	ranged := blocked(t, func() error { return hs[2].LockRange(memfs.SharedLock, 5, 5, true) })
+	if err := hs[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := result(t, flock); err != nil {
+		t.Errorf("flock after holder closed: %v", err)
+	}
+	if err := result(t, ranged); err != nil {
+		t.Errorf("range lock after holder closed: %v", err)
+	}
+
+	// a closed waiter gives up
+	done := blocked(t, func() error { return hs[2].Flock(memfs.ExclusiveLock, true) })
+	if err := hs[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := result(t, done); !errors.Is(err, memfs.ErrBadFd) {
+		t.Errorf("closed waiter: %v, want %v", err, memfs.ErrBadFd)
+	}
+	if l, err := hs[1].TestRange(memfs.ExclusiveLock, 0, 0); err != nil || l != nil {
+		t.Errorf("locks left by closed handles: %+v, %v", l, err)
+	}
+}
+
+func TestLockRanges(t *testing.T) {
+	_, hs := openLocked(t, 2)
+	h, other := hs[0], hs[1]
+	lock := func(typ memfs.LockType, off, length int64) {
+		t.Helper()
+		if err := h.LockRange(typ, off, length, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// check tells which lock of h keeps other from locking [off, off+length)
+	check := func(typ memfs.LockType, off, length int64, want *memfs.RangeLock) {
+		t.Helper()
+		got, err := other.TestRange(typ, off, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil && got != nil || want != nil && (got == nil || *got != *want) {
+			t.Errorf("test [%d, +%d): %+v, want %+v", off, length, got, want)
+		}
+	}
+	fd := h.Fd()
+
+	// unlocking the middle splits a range
+	lock(memfs.ExclusiveLock, 0, 100)
+	lock(memfs.Unlock, 40, 20)
+	check(memfs.SharedLock, 40, 20, nil)
+	check(memfs.SharedLock, 0, 50, &memfs.RangeLock{Type: memfs.ExclusiveLock, Off: 0, Len: 40, Fd: fd})
+	check(memfs.SharedLock, 50, 0, &memfs.RangeLock{Type: memfs.ExclusiveLock, Off: 60, Len: 40, Fd: fd})
+
+	// adjacent ranges of the same type merge
+	lock(memfs.ExclusiveLock, 40, 20)
+	check(memfs.SharedLock, 0, 0, &memfs.RangeLock{Type: memfs.ExclusiveLock, Off: 0, Len: 100, Fd: fd})
+
+	// a lock of another type inside splits the range around it
+	lock(memfs.SharedLock, 30, 10)
+	check(memfs.SharedLock, 0, 0, &memfs.RangeLock{Type: memfs.ExclusiveLock, Off: 0, Len: 30, Fd: fd})
+	check(memfs.SharedLock, 30, 10, nil)
+	check(memfs.ExclusiveLock, 30, 10, &memfs.RangeLock{Type: memfs.SharedLock, Off: 30, Len: 10, Fd: fd})
+	check(memfs.SharedLock, 35, 0, &memfs.RangeLock{Type: memfs.ExclusiveLock, Off: 40, Len: 60, Fd: fd})
+
+	// overlapping shared locks merge, up to any size
+	lock(memfs.SharedLock, 0, 0)
+	check(memfs.SharedLock, 0, 0, nil)
+	check(memfs.ExclusiveLock, 500, 1, &memfs.RangeLock{Type: memfs.SharedLock, Off: 0, Len: 0, Fd: fd})
+
+	lock(memfs.Unlock, 0, 0)
+	check(memfs.ExclusiveLock, 0, 0, nil)
+}
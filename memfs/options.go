@@ -0,0 +1,61 @@
+package memfs
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// DefaultBlockSize - block size used when Options doesn't set one,
+// file data is allocated and accounted in blocks of this size
+const DefaultBlockSize = 8
+
+// Options - settings of a new filesystem, zero values mean defaults
+type Options struct {
+	// BlockSize - size of file data blocks in bytes
+	BlockSize int
+	// Capacity - limit of bytes taken by file data blocks, 0 is unlimited
+	Capacity int64
+	// MaxInodes - limit of inodes count including root, 0 is unlimited
+	MaxInodes int
+}
+
+// Options returns settings the filesystem was created with
+func (fs *MemFS) Options() Options {
+	return Options{
+		BlockSize: fs.blksize,
+		Capacity:  fs.capacity,
+		MaxInodes: fs.maxInodes,
+	}
+}
+
+// Used - bytes taken by file data blocks
+func (fs *MemFS) Used() int64 {
+	return atomic.LoadInt64(&fs.used)
+}
+
+// reserve accounts blocks n needs to hold data in range [off, end),
+// fails with ENOSPC if they don't fit in the capacity. Caller holds n lock
+func (fs *MemFS) reserve(n *inode, off, end int64) error {
+	need := n.missing(off, end)
+	if need <= 0 {
+		return nil
+	}
+
+	bytes := int64(need * n.blksize)
+	for {
+		used := atomic.LoadInt64(&fs.used)
+		if fs.capacity > 0 && used+bytes > fs.capacity {
+			return syscall.ENOSPC
+		}
+		if atomic.CompareAndSwapInt64(&fs.used, used, used+bytes) {
+			return nil
+		}
+	}
+}
+
+// reclaim returns space of blocks n dropped since it had count of them
+func (fs *MemFS) reclaim(n *inode, count int) {
+	if freed := count - n.Blocks(); freed > 0 {
+		atomic.AddInt64(&fs.used, -int64(freed*n.blksize))
+	}
+}
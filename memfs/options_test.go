@@ -0,0 +1,135 @@
+package memfs_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"fs/memfs"
+)
+
+func TestCapacity(t *testing.T) {
+	const blksize = 512
+	fs := memfs.Create(memfs.Options{BlockSize: blksize, Capacity: 8 * blksize})
+
+	h, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// fill the filesystem up
+	full := bytes.Repeat([]byte{'x'}, 8*blksize)
+	if n, err := h.WriteAt(full, 0); n != len(full) || err != nil {
+		t.Fatalf("filling write: %d, %v", n, err)
+	}
+	if used := fs.Used(); used != 8*blksize {
+		t.Fatalf("used %d after filling, want %d", used, 8*blksize)
+	}
+
+	// a write needing a new block fails as a whole, one within
+	// allocated blocks still succeeds
+	if n, err := h.WriteAt([]byte("y"), 8*blksize); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write past capacity: %d, %v, want ENOSPC", n, err)
+	}
+	if _, err := h.WriteAt([]byte("y"), 0); err != nil {
+		t.Fatalf("overwrite of allocated block: %v", err)
+	}
+	h2, err := fs.OpenFile("/g", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h2.Write([]byte("z")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write to another file: %v, want ENOSPC", err)
+	}
+
+	// truncate and punched holes give blocks back
+	if err := h.Truncate(6 * blksize); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.Used(); used != 6*blksize {
+		t.Fatalf("used %d after truncate, want %d", used, 6*blksize)
+	}
+	if err := h.PunchHole(blksize, 2*blksize); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.Used(); used != 4*blksize {
+		t.Fatalf("used %d after punch, want %d", used, 4*blksize)
+	}
+	if n, err := h2.Write(full[:4*blksize]); n != 4*blksize || err != nil {
+		t.Fatalf("write to reclaimed space: %d, %v", n, err)
+	}
+	if _, err := h2.Write([]byte("z")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write past capacity again: %v, want ENOSPC", err)
+	}
+	h2.Close()
+
+	// removed file keeps its blocks while open, they come back on close
+	if err := fs.Unlink("/f"); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.Used(); used != 8*blksize {
+		t.Fatalf("used %d with unlinked open file, want %d", used, 8*blksize)
+	}
+	h.Close()
+	if used := fs.Used(); used != 4*blksize {
+		t.Fatalf("used %d after close, want %d", used, 4*blksize)
+	}
+	if err := fs.Unlink("/g"); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.Used(); used != 0 {
+		t.Fatalf("used %d on empty filesystem", used)
+	}
+}
+
+func TestMaxInodes(t *testing.T) {
+	// root and three more inodes
+	fs := memfs.Create(memfs.Options{MaxInodes: 4})
+
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/dir/f", "data")
+	if err := fs.Symlink("/dir/f", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	full := []struct {
+		name string
+		fn   func() error
+	}{
+		{"mkdir", func() error { return fs.Mkdir("/d2") }},
+		{"create", func() error { return fs.Create("/g") }},
+		{"open", func() error {
+			_, err := fs.OpenFile("/g", os.O_WRONLY|os.O_CREATE, 0644)
+			return err
+		}},
+		{"symlink", func() error { return fs.Symlink("f", "/dir/l2") }},
+	}
+	for _, op := range full {
+		if err := op.fn(); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("%s on full inode table: %v, want ENOSPC", op.name, err)
+		}
+	}
+
+	// hard links take no inode
+	if err := fs.Link("/dir/f", "/hard"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	// inode is freed with its last link
+	if err := fs.Unlink("/dir/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create("/g"); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("create with a link left: %v, want ENOSPC", err)
+	}
+	if err := fs.Unlink("/hard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create("/g"); err != nil {
+		t.Fatalf("create after unlink: %v", err)
+	}
+}
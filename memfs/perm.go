@@ -0,0 +1,243 @@
+package memfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// access mask bits, same as rwx bits of "other" class
+const (
+	mayExec  os.FileMode = 1
+	mayWrite os.FileMode = 2
+	mayRead  os.FileMode = 4
+)
+
+// mode bits that can be changed with Chmod
+const modeChmod = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+const defaultUmask os.FileMode = 022
+
+// Cred - credential the filesystem is accessed with
+type Cred struct {
+	Uid    int
+	Gid    int
+	Groups []int
+}
+
+// member checks if gid is one of the credential groups
+func (c *Cred) member(gid int) bool {
+	if c.Gid == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Cred returns credential used for access checks
+func (fs *MemFS) Cred() Cred {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.cred
+}
+
+// SetCred changes credential used for access checks, uid 0 bypasses them
+func (fs *MemFS) SetCred(c Cred) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.cred = c
+}
+
+// Umask returns file mode creation mask
+func (fs *MemFS) Umask() os.FileMode {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.umask
+}
+
+// SetUmask changes file mode creation mask and returns the previous one
+func (fs *MemFS) SetUmask(mask os.FileMode) os.FileMode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	old := fs.umask
+	fs.umask = mask & os.ModePerm
+	return old
+}
+
+// WithCred returns view of the filesystem acting with credential c and
+// umask. The view shares the tree, descriptors and settings with fs,
+// while its credential is its own: fs and other goroutines using it
+// keep acting with theirs
+func (fs *MemFS) WithCred(c Cred, umask os.FileMode) *MemFS {
+	return &MemFS{tree: fs.tree, cred: c, umask: umask & os.ModePerm}
+}
+
+// access checks if caller is allowed to access n with mask
+func (fs *MemFS) access(n *inode, mask os.FileMode) bool {
+	if fs.cred.Uid == 0 {
+		// root can't execute files nobody can execute
+		return mask&mayExec == 0 || n.dir || n.mode&0111 != 0
+	}
+
+	perm := n.mode.Perm()
+	switch {
+	case n.uid == fs.cred.Uid:
+		perm >>= 6
+	case fs.cred.member(n.gid):
+		perm >>= 3
+	}
+	return perm&mask == mask
+}
+
+// mayDelete checks if caller can remove entry n from dir,
+// sticky directory allows it only to owners of the entry or directory
+func (fs *MemFS) mayDelete(dir, n *inode) bool {
+	if !fs.access(dir, mayWrite|mayExec) {
+		return false
+	}
+	if dir.mode&os.ModeSticky == 0 || fs.cred.Uid == 0 {
+		return true
+	}
+	return n.uid == fs.cred.Uid || dir.uid == fs.cred.Uid
+}
+
+// owner checks if caller owns n or is root
+func (fs *MemFS) owner(n *inode) bool {
+	return fs.cred.Uid == 0 || n.uid == fs.cred.Uid
+}
+
+// mknod allocates n owned by caller and links it to parent as name.
+// Permission bits of n are masked with umask unless it is a symlink
+func (fs *MemFS) mknod(parent *inode, name string, n *inode) (*inode, error) {
+	if fs.readonly() {
+		return nil, syscall.EROFS
+	}
+	if fs.maxInodes > 0 && fs.inodes.len() >= fs.maxInodes {
+		return nil, syscall.ENOSPC
+	}
+
+	fs.alloc(n)
+	n.uid, n.gid = fs.cred.Uid, fs.cred.Gid
+	if !n.symlink() {
+		n.mode &^= fs.umask
+	}
+
+	// setgid directory passes its group down
+	if parent.mode&os.ModeSetgid != 0 {
+		n.gid = parent.gid
+		if n.dir {
+			n.mode |= os.ModeSetgid
+		}
+	}
+
+	fs.link(parent, name, n)
+	fs.log(&record{
+		op:     opMknod,
+		parent: parent.ino,
+		name:   name,
+		ino:    n.ino,
+		mode:   n.Mode(),
+		uid:    n.uid,
+		gid:    n.gid,
+		target: n.target,
+		time:   n.btime,
+	})
+	fs.notify(OpCreate, parent, name)
+	return n, nil
+}
+
+// Chmod changes mode of the named file, symlinks are followed
+func (fs *MemFS) Chmod(name string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "chmod", Path: name, Err: syscall.EROFS}
+	}
+
+	name = filepath.Clean(name)
+	_, f, err := fs.follow(name)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	if f == nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	if !fs.owner(f.inode) {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrPermission}
+	}
+
+	mode &= modeChmod
+	if fs.cred.Uid != 0 && !f.dir && !fs.cred.member(f.gid) {
+		mode &^= os.ModeSetgid
+	}
+	fs.cow(f.inode)
+	f.mode = f.mode&^modeChmod | mode
+	fs.changed(f.inode)
+	fs.logAttr(f.inode)
+	fs.notifyFile(OpChmod, f)
+	return nil
+}
+
+// Chown changes owner and group of the named file, symlinks are followed.
+// uid or gid -1 leaves the value unchanged
+func (fs *MemFS) Chown(name string, uid, gid int) error {
+	return fs.chown("chown", name, uid, gid, true)
+}
+
+// Lchown is like Chown but changes the symlink itself
+func (fs *MemFS) Lchown(name string, uid, gid int) error {
+	return fs.chown("lchown", name, uid, gid, false)
+}
+
+func (fs *MemFS) chown(op, name string, uid, gid int, follow bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+	}
+
+	name = filepath.Clean(name)
+	resolve := fs.file
+	if follow {
+		resolve = fs.follow
+	}
+
+	_, f, err := resolve(name)
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if f == nil {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+
+	if uid == -1 {
+		uid = f.uid
+	}
+	if gid == -1 {
+		gid = f.gid
+	}
+
+	// only root gives files away, owner may pick one of its groups
+	if fs.cred.Uid != 0 {
+		if f.uid != fs.cred.Uid || uid != f.uid || gid != f.gid && !fs.cred.member(gid) {
+			return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+		}
+	}
+
+	fs.cow(f.inode)
+	if !f.dir && !f.symlink() && (uid != f.uid || gid != f.gid) {
+		f.mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	f.uid, f.gid = uid, gid
+	fs.changed(f.inode)
+	fs.logAttr(f.inode)
+	fs.notifyFile(OpAttrib, f)
+	return nil
+}
@@ -0,0 +1,277 @@
+package memfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Snapshots share inodes and data blocks with the live tree.
+//
+// Every snapshot starts a new generation of the filesystem. The snapshot
+// keeps a fork of the inode table, so taking it costs O(1). An inode changed
+// for the first time in a generation keeps a frozen copy of its previous
+// state in its history, and snapshots older than the change see that copy.
+// The copy shares extents with the inode, extents of older generations are
+// never changed in place, the blocks written are copied instead
+
+// snapshot - named read-only state of the tree
+type snapshot struct {
+	name    string
+	gen     uint64
+	created time.Time
+	inodes  itable
+}
+
+// inode finds inode ino, a mounted snapshot finds the version it holds
+func (fs *MemFS) inode(ino uint64) *inode {
+	n := fs.inodes.get(ino)
+	if n == nil || fs.origin == nil {
+		return n
+	}
+	return fs.origin.pin(n, fs.snap.gen)
+}
+
+// readonly checks if filesystem is a mounted snapshot
+func (fs *MemFS) readonly() bool {
+	return fs.snap != nil
+}
+
+// cow saves the current state of n in its history before the first change
+// since the newest snapshot. Caller holds the tree lock exclusively
+// or together with n lock
+func (fs *MemFS) cow(n *inode) {
+	if n.gen >= fs.gen {
+		return
+	}
+	n.history = append(n.history, n.freeze())
+	n.gen = fs.gen
+}
+
+// pin finds version of n seen by snapshot gen. Current state of n is saved
+// in its history first, so the version doesn't change with n
+func (fs *MemFS) pin(n *inode, gen uint64) *inode {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fs.cow(n)
+	return n.at(gen)
+}
+
+// at finds version of n seen by snapshot gen
+func (n *inode) at(gen uint64) *inode {
+	if n.gen <= gen {
+		return n
+	}
+	for i := len(n.history) - 1; i >= 0; i-- {
+		if n.history[i].gen <= gen {
+			return n.history[i]
+		}
+	}
+	return nil
+}
+
+// freeze copies n, extents are shared with the copy
+func (n *inode) freeze() *inode {
+	c := &inode{
+		ino:     n.ino,
+		dir:     n.dir,
+		mode:    n.mode,
+		uid:     n.uid,
+		gid:     n.gid,
+		nlink:   n.nlink,
+		size:    n.size,
+		data:    n.data.clone(),
+		blksize: n.blksize,
+		atime:   n.atime,
+		mtime:   n.mtime,
+		ctime:   n.ctime,
+		btime:   n.btime,
+		dotdot:  n.dotdot,
+		target:  n.target,
+		gen:     n.gen,
+	}
+	if n.entries != nil {
+		c.entries = make(map[string]uint64, len(n.entries))
+		for name, ino := range n.entries {
+			c.entries[name] = ino
+		}
+	}
+	return c
+}
+
+// shared checks if extent e of n may be seen by snapshots
+func (n *inode) shared(e *extent) bool {
+	return e.gen < n.gen
+}
+
+// own makes blocks of extent e covering range [off, end) private to n,
+// so they can be changed in place. Blocks around them stay shared.
+// Returns extent holding the range
+func (n *inode) own(e *extent, off, end int64) *extent {
+	if !n.shared(e) {
+		return e
+	}
+
+	from, to := n.alignDown(off), n.alignUp(end)
+	if from < e.off {
+		from = e.off
+	}
+	if to > e.end() {
+		to = e.end()
+	}
+
+	n.data.remove(e)
+	if from > e.off {
+		n.data.insert(&extent{off: e.off, data: e.data[: from-e.off : from-e.off], gen: e.gen})
+	}
+	if to < e.end() {
+		n.data.insert(&extent{off: to, data: e.data[to-e.off:], gen: e.gen})
+	}
+	own := &extent{off: from, data: append([]byte(nil), e.data[from-e.off:to-e.off]...), gen: n.gen}
+	n.data.insert(own)
+	return own
+}
+
+// snapshot looks snapshot up by name
+func (fs *MemFS) snapshot(name string) *snapshot {
+	for _, s := range fs.snapshots {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Snapshot saves the current state of the tree as read-only snapshot name.
+// It costs O(1), inodes and blocks are copied only when the live tree
+// changes them. Capacity limits count blocks of the live tree only
+func (fs *MemFS) Snapshot(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "snapshot", Path: name, Err: syscall.EROFS}
+	}
+	if name == "" {
+		return &os.PathError{Op: "snapshot", Path: name, Err: syscall.EINVAL}
+	}
+	if fs.snapshot(name) != nil {
+		return &os.PathError{Op: "snapshot", Path: name, Err: os.ErrExist}
+	}
+
+	fs.takeSnapshot(name)
+	fs.log(&record{op: opSnapshot, name: name})
+	return nil
+}
+
+// takeSnapshot - caller holds the tree lock exclusively
+func (fs *MemFS) takeSnapshot(name string) {
+	fs.snapshots = append(fs.snapshots, &snapshot{
+		name:    name,
+		gen:     fs.gen,
+		created: fs.now(),
+		inodes:  fs.inodes.fork(),
+	})
+	fs.gen++
+}
+
+// Snapshots returns names of snapshots from the oldest one
+func (fs *MemFS) Snapshots() []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	names := make([]string, 0, len(fs.snapshots))
+	for _, s := range fs.snapshots {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// Restore rolls the live tree back to snapshot name, it fails with EBUSY
+// while files are open. The snapshot is kept
+func (fs *MemFS) Restore(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "restore", Path: name, Err: syscall.EROFS}
+	}
+	s := fs.snapshot(name)
+	if s == nil {
+		return &os.PathError{Op: "restore", Path: name, Err: os.ErrNotExist}
+	}
+	for _, h := range fs.opened.handles {
+		if h != nil {
+			return &os.PathError{Op: "restore", Path: name, Err: syscall.EBUSY}
+		}
+	}
+
+	fs.restore(s)
+	fs.log(&record{op: opRestore, name: name})
+	fs.overflow()
+	return nil
+}
+
+// restore - caller holds the tree lock exclusively
+func (fs *MemFS) restore(s *snapshot) {
+	inodes := s.inodes.fork()
+	var used int64
+	s.inodes.ascend(func(n *inode) bool {
+		v := n.at(s.gen)
+		switch {
+		case v.nlink == 0:
+			// unlinked file that was open when the snapshot was taken
+			inodes.delete(n.ino)
+			return true
+		case v != n:
+			// inode changed since, its version becomes live again
+			v = v.freeze()
+			v.gen = fs.gen
+			inodes.set(v.ino, v)
+		}
+		used += v.data.size
+		return true
+	})
+
+	fs.inodes = inodes
+	fs.root = fs.inodes.get(0)
+	fs.wd = fs.root
+	fs.used = used
+}
+
+// MountSnapshot returns read-only filesystem holding the tree of snapshot
+// name. It stays unchanged while the live tree changes, changes fail with EROFS
+func (fs *MemFS) MountSnapshot(name string) (*MemFS, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	s := fs.snapshot(name)
+	if s == nil {
+		return nil, &os.PathError{Op: "mount", Path: name, Err: os.ErrNotExist}
+	}
+
+	root := s.inodes.get(0)
+	fs.cow(root)
+	root = root.at(s.gen)
+
+	return &MemFS{
+		tree: &tree{
+			root:      root,
+			wd:        root,
+			inodes:    s.inodes,
+			clock:     fs.clock,
+			atime:     NoAtime,
+			blksize:   fs.blksize,
+			capacity:  fs.capacity,
+			maxInodes: fs.maxInodes,
+			used:      fs.used,
+			origin:    fs,
+			snap:      s,
+		},
+		cred:  fs.cred,
+		umask: fs.umask,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package memfs
+
+import (
+	"syscall"
+)
+
+// whence values of Seek looking for data and holes of sparse files,
+// same as SEEK_DATA and SEEK_HOLE on Linux
+const (
+	// SeekData seeks to the next data region at or after offset
+	SeekData = 3
+	// SeekHole seeks to the next hole at or after offset,
+	// end of file counts as a hole
+	SeekHole = 4
+)
+
+// missing counts unallocated blocks in range [off, end)
+func (n *inode) missing(off, end int64) int {
+	if end <= off {
+		return 0
+	}
+
+	from, to := n.alignDown(off), n.alignUp(end)
+	holes := to - from
+	n.data.ascend(from, func(e *extent) bool {
+		if e.off >= to {
+			return false
+		}
+		a, b := e.off, e.end()
+		if a < from {
+			a = from
+		}
+		if b > to {
+			b = to
+		}
+		holes -= b - a
+		return true
+	})
+	return int(holes / int64(n.blksize))
+}
+
+// punch frees blocks in range [off, off+length) and zeroes partly covered ones
+func (n *inode) punch(off, length int64) {
+	end := off + length
+	from, to := n.alignUp(off), n.alignDown(end)
+	if from > to {
+		// range is inside a single block
+		n.zero(off, end)
+		return
+	}
+
+	n.zero(off, from)
+	n.zero(to, end)
+	n.free(from, to)
+}
+
+// zero fills range [off, end) within a single block with zeros
+func (n *inode) zero(off, end int64) {
+	if off >= end {
+		return
+	}
+	if e := n.data.extentAt(off); e != nil {
+		e = n.own(e, off, end)
+		zero(e.data[off-e.off : end-e.off])
+	}
+}
+
+// free drops blocks in block aligned range [from, to)
+func (n *inode) free(from, to int64) {
+	var hit []*extent
+	n.data.ascend(from, func(e *extent) bool {
+		if e.off >= to {
+			return false
+		}
+		hit = append(hit, e)
+		return true
+	})
+
+	// parts outside the range are kept, shared ones stay shared
+	for _, e := range hit {
+		n.data.remove(e)
+		if from > e.off {
+			n.data.insert(&extent{off: e.off, data: shrink(e.data, 0, from-e.off), gen: e.gen})
+		}
+		if to < e.end() {
+			n.data.insert(&extent{off: to, data: shrink(e.data, to-e.off, int64(len(e.data))), gen: e.gen})
+		}
+	}
+}
+
+// shrink returns data[from:to], copied if it is small enough
+// for the rest of the buffer to be worth freeing
+func shrink(data []byte, from, to int64) []byte {
+	if 2*(to-from) < int64(cap(data)) {
+		return append([]byte(nil), data[from:to]...)
+	}
+	return data[from:to:to]
+}
+
+// zero fills b with zeros
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// seekData finds start of the data region at or after off
+func (n *inode) seekData(off int64) (int64, error) {
+	size := n.Size()
+	if off < 0 || off >= size {
+		return 0, syscall.ENXIO
+	}
+
+	if n.data.extentAt(off) != nil {
+		return off, nil
+	}
+	next := n.data.ceil(off)
+	if next == nil || next.off >= size {
+		return 0, syscall.ENXIO
+	}
+	return next.off, nil
+}
+
+// seekHole finds start of the hole at or after off
+func (n *inode) seekHole(off int64) (int64, error) {
+	size := n.Size()
+	if off < 0 || off >= size {
+		return 0, syscall.ENXIO
+	}
+
+	// skip adjacent extents
+	for e := n.data.extentAt(off); e != nil; e = n.data.extentAt(off) {
+		off = e.end()
+	}
+	if off > size {
+		return size, nil
+	}
+	return off, nil
+}
+
+// seek resolves SeekData or SeekHole offset
+func (f *File) seek(off int64, whence int) (int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if whence == SeekData {
+		return f.inode.seekData(off)
+	}
+	return f.inode.seekHole(off)
+}
+
+// PunchHole frees data in range [off, off+length), the range reads as zeros
+// and file size is kept
+func (f *File) PunchHole(off, length int64) error {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fs.punchHole(f.inode, off, length); err != nil {
+		return err
+	}
+	f.fs.notifyFile(OpWrite, f)
+	return nil
+}
+
+// punchHole frees data of n in range [off, off+length), caller holds n lock
+func (fs *MemFS) punchHole(n *inode, off, length int64) error {
+	if fs.readonly() {
+		return syscall.EROFS
+	}
+	if off < 0 || length <= 0 {
+		return syscall.EINVAL
+	}
+
+	// bytes past the end are zero, so the last block is freed whole
+	if off+length >= n.size {
+		length = n.alignUp(n.size) - off
+	}
+
+	fs.cow(n)
+	count := n.Blocks()
+	n.punch(off, length)
+	fs.reclaim(n, count)
+	fs.modified(n)
+	fs.log(&record{op: opPunch, ino: n.ino, off: off, size: length, time: n.ctime})
+	return nil
+}
+
+// PunchHole frees data in range [off, off+length) of the opened file
+func (h *Handle) PunchHole(off, length int64) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := h.check("punch", true); err != nil {
+		return err
+	}
+	if err := h.file.PunchHole(off, length); err != nil {
+		return h.error("punch", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"strconv"
+	"testing"
+
+	"fs/memfs"
+)
+
+// TestStress runs readers of different files in parallel with writers,
+// renames, snapshots and lock holders on the same filesystem. It is
+// meant to be run with -race
+func TestStress(t *testing.T) {
+	const workers = 4
+	rounds := 300
+	if testing.Short() {
+		rounds = 50
+	}
+
+	fs := memfs.Create()
+	content := func(i int) string {
+		return fmt.Sprintf("content of reader %d ", i) + string(bytes.Repeat([]byte{byte('a' + i)}, 8192))
+	}
+	for i := 0; i < workers; i++ {
+		writeFile(t, fs, fmt.Sprintf("/r%d", i), content(i))
+		if err := fs.Mkdir(fmt.Sprintf("/m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fs, fmt.Sprintf("/m%d/a", i), "moved")
+	}
+	writeFile(t, fs, "/flock", "0")
+	writeFile(t, fs, "/range", "0")
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < workers; i++ {
+			i := i
+			t.Run(fmt.Sprintf("read%d", i), func(t *testing.T) {
+				t.Parallel()
+				stressRead(t, fs, fmt.Sprintf("/r%d", i), content(i), rounds)
+			})
+			t.Run(fmt.Sprintf("write%d", i), func(t *testing.T) {
+				t.Parallel()
+				stressWrite(t, fs, fmt.Sprintf("/w%d", i), rounds)
+			})
+			t.Run(fmt.Sprintf("rename%d", i), func(t *testing.T) {
+				t.Parallel()
+				stressRename(t, fs, fmt.Sprintf("/m%d", i), rounds)
+			})
+			t.Run(fmt.Sprintf("flock%d", i), func(t *testing.T) {
+				t.Parallel()
+				stressLock(t, fs, "/flock", rounds, func(h *memfs.Handle, typ memfs.LockType) error {
+					return h.Flock(typ, true)
+				})
+			})
+			t.Run(fmt.Sprintf("lockrange%d", i), func(t *testing.T) {
+				t.Parallel()
+				stressLock(t, fs, "/range", rounds, func(h *memfs.Handle, typ memfs.LockType) error {
+					return h.LockRange(typ, 0, 0, true)
+				})
+			})
+		}
+		t.Run("snapshot", func(t *testing.T) {
+			t.Parallel()
+			stressSnapshot(t, fs, content(0), rounds/10)
+		})
+	})
+
+	// every increment done under a lock is kept
+	for _, name := range []string{"/flock", "/range"} {
+		data, err := fs.Cat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(workers * rounds); data != want {
+			t.Errorf("%s: counter %s, want %s", name, data, want)
+		}
+	}
+}
+
+// stressRead reads name through a handle, Cat and IOFS
+func stressRead(t *testing.T, fs *memfs.MemFS, name, want string, rounds int) {
+	h, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	buf := make([]byte, len(want))
+	for i := 0; i < rounds; i++ {
+		n, err := h.ReadAt(buf, 0)
+		if n != len(want) || string(buf) != want {
+			t.Fatalf("ReadAt: %d bytes, %v", n, err)
+		}
+		if data, err := fs.Cat(name); err != nil || data != want {
+			t.Fatalf("Cat: %v", err)
+		}
+		if data, err := iofs.ReadFile(fs.IOFS(), name[1:]); err != nil || string(data) != want {
+			t.Fatalf("ReadFile: %v", err)
+		}
+	}
+}
+
+// stressWrite writes name in chunks and reads them back
+func stressWrite(t *testing.T, fs *memfs.MemFS, name string, rounds int) {
+	h, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	chunk := make([]byte, 100)
+	got := make([]byte, len(chunk))
+	for i := 0; i < rounds; i++ {
+		copy(chunk, fmt.Sprintf("chunk %d", i))
+		off := int64(i%20) * int64(len(chunk))
+		if _, err := h.WriteAt(chunk, off); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.ReadAt(got, off); err != nil || !bytes.Equal(got, chunk) {
+			t.Fatalf("read back at %d: %q, %v", off, got, err)
+		}
+		if i%50 == 49 {
+			if err := h.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// stressRename moves a file of dir back and forth and lists dir
+func stressRename(t *testing.T, fs *memfs.MemFS, dir string, rounds int) {
+	names := []string{dir + "/a", dir + "/b"}
+	for i := 0; i < rounds; i++ {
+		from, to := names[i%2], names[(i+1)%2]
+		if err := fs.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Lstat(to); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := fs.IOFS().ReadDir(dir[1:])
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("ReadDir: %d entries, %v", len(entries), err)
+		}
+	}
+}
+
+// stressLock increments counter of name holding an exclusive lock
+func stressLock(t *testing.T, fs *memfs.MemFS, name string, rounds int, lock func(*memfs.Handle, memfs.LockType) error) {
+	h, err := fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	buf := make([]byte, 32)
+	for i := 0; i < rounds; i++ {
+		if err := lock(h, memfs.ExclusiveLock); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := h.ReadAt(buf, 0)
+		v, err := strconv.Atoi(string(buf[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.WriteAt([]byte(strconv.Itoa(v+1)), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := lock(h, memfs.Unlock); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stressSnapshot takes snapshots of the changing tree and reads them
+func stressSnapshot(t *testing.T, fs *memfs.MemFS, want string, rounds int) {
+	for i := 0; i < rounds; i++ {
+		name := fmt.Sprintf("s%d", i)
+		if err := fs.Snapshot(name); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := fs.MountSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := snap.Cat("/r0"); err != nil || data != want {
+			t.Fatalf("snapshot %s: %v", name, err)
+		}
+		if _, err := iofs.ReadDir(snap.IOFS(), "."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(fs.Snapshots()); n != rounds {
+		t.Errorf("%d snapshots, want %d", n, rounds)
+	}
+}
@@ -0,0 +1,113 @@
+package memfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// AtimeMode - when reads update access time, like atime mount options
+type AtimeMode int
+
+const (
+	// RelAtime updates access time only if it is older than modification
+	// or change time, or more than a day old
+	RelAtime AtimeMode = iota
+	// StrictAtime updates access time on every read
+	StrictAtime
+	// NoAtime never updates access time on reads
+	NoAtime
+)
+
+// SetClock replaces clock used for timestamps, nil restores time.Now
+func (fs *MemFS) SetClock(now func() time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.clock = now
+}
+
+// SetAtime changes access time update mode
+func (fs *MemFS) SetAtime(mode AtimeMode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.atime = mode
+}
+
+func (fs *MemFS) now() time.Time {
+	if fs.clock != nil {
+		return fs.clock()
+	}
+	return time.Now()
+}
+
+// modified updates modification and change time of n,
+// caller holds the tree lock exclusively or n lock
+func (fs *MemFS) modified(n *inode) {
+	now := fs.now()
+	n.mtime, n.ctime = now, now
+}
+
+// changed updates change time of n,
+// caller holds the tree lock exclusively or n lock
+func (fs *MemFS) changed(n *inode) {
+	n.ctime = fs.now()
+}
+
+// accessed updates access time of n according to atime mode,
+// caller holds the tree lock but not n lock
+func (fs *MemFS) accessed(n *inode) {
+	if fs.atime == NoAtime || fs.readonly() {
+		return
+	}
+
+	now := fs.now()
+	if fs.atime == RelAtime {
+		n.mu.RLock()
+		fresh := n.atime.After(n.mtime) && n.atime.After(n.ctime) && now.Sub(n.atime) < 24*time.Hour
+		n.mu.RUnlock()
+		if fresh {
+			return
+		}
+	}
+
+	n.mu.Lock()
+	fs.cow(n)
+	n.atime = now
+	n.mu.Unlock()
+}
+
+// Chtimes changes access and modification time of the named file,
+// symlinks are followed. Zero time leaves the value unchanged
+func (fs *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readonly() {
+		return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EROFS}
+	}
+
+	name = filepath.Clean(name)
+	_, f, err := fs.follow(name)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	if f == nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	if !fs.owner(f.inode) {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrPermission}
+	}
+
+	fs.cow(f.inode)
+	if !atime.IsZero() {
+		f.atime = atime
+	}
+	if !mtime.IsZero() {
+		f.mtime = mtime
+	}
+	fs.changed(f.inode)
+	fs.logAttr(f.inode)
+	fs.notifyFile(OpAttrib, f)
+	return nil
+}
@@ -0,0 +1,174 @@
+package memfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fs/memfs"
+)
+
+// fakeClock - clock of a filesystem moved by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) tick(d time.Duration) time.Time {
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// fileTimes - timestamps of a file
+type fileTimes struct {
+	atime, mtime, ctime, btime time.Time
+}
+
+func times(t *testing.T, fs *memfs.MemFS, name string) fileTimes {
+	t.Helper()
+	info, err := fs.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := info.(interface {
+		AccessTime() time.Time
+		ChangeTime() time.Time
+		BirthTime() time.Time
+	})
+	return fileTimes{
+		atime: i.AccessTime(),
+		mtime: info.ModTime(),
+		ctime: i.ChangeTime(),
+		btime: i.BirthTime(),
+	}
+}
+
+// clocked creates filesystem with a fake clock
+func clocked() (*memfs.MemFS, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fs := memfs.Create()
+	fs.SetClock(clock.Now)
+	return fs, clock
+}
+
+func TestAtimeModes(t *testing.T) {
+	tests := []struct {
+		name string
+		mode memfs.AtimeMode
+		// access time expected after reads a minute,
+		// two minutes and a day and two minutes after creation
+		want [3]int
+	}{
+		{"strict", memfs.StrictAtime, [3]int{1, 2, 3}},
+		{"relatime", memfs.RelAtime, [3]int{1, 1, 3}},
+		{"noatime", memfs.NoAtime, [3]int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, clock := clocked()
+			fs.SetAtime(tt.mode)
+			writeFile(t, fs, "/f", "data")
+
+			stamps := []time.Time{clock.now}
+			for i, d := range []time.Duration{time.Minute, time.Minute, 24 * time.Hour} {
+				stamps = append(stamps, clock.tick(d))
+				if _, err := fs.Cat("/f"); err != nil {
+					t.Fatal(err)
+				}
+				if got := times(t, fs, "/f").atime; !got.Equal(stamps[tt.want[i]]) {
+					t.Errorf("read %d: atime %v, want %v", i+1, got, stamps[tt.want[i]])
+				}
+			}
+		})
+	}
+}
+
+func TestChangeTimes(t *testing.T) {
+	fs, clock := clocked()
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	created := clock.now
+	writeFile(t, fs, "/dir/f", "data")
+
+	// chmod changes only ctime
+	chmod := clock.tick(time.Second)
+	if err := fs.Chmod("/dir/f", 0600); err != nil {
+		t.Fatal(err)
+	}
+	got := times(t, fs, "/dir/f")
+	if !got.ctime.Equal(chmod) || !got.mtime.Equal(created) {
+		t.Errorf("chmod: %+v", got)
+	}
+
+	// write changes mtime and ctime
+	write := clock.tick(time.Second)
+	h, err := fs.OpenFile("/dir/f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt([]byte("more"), 4); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	got = times(t, fs, "/dir/f")
+	if !got.ctime.Equal(write) || !got.mtime.Equal(write) {
+		t.Errorf("write: %+v", got)
+	}
+
+	// rename changes ctime of the file and mtime of both parents
+	rename := clock.tick(time.Second)
+	if err := fs.Rename("/dir/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	got = times(t, fs, "/g")
+	if !got.ctime.Equal(rename) || !got.mtime.Equal(write) {
+		t.Errorf("rename: %+v", got)
+	}
+	for _, dir := range []string{"/", "/dir"} {
+		if got := times(t, fs, dir); !got.mtime.Equal(rename) || !got.ctime.Equal(rename) {
+			t.Errorf("rename: parent %s %+v", dir, got)
+		}
+	}
+
+	// birth time stays
+	if !got.btime.Equal(created) {
+		t.Errorf("btime %v, want %v", got.btime, created)
+	}
+}
+
+func TestTimesSaveLoad(t *testing.T) {
+	fs, clock := clocked()
+	writeFile(t, fs, "/f", "data")
+	clock.tick(time.Hour)
+	if err := fs.Chmod("/f", 0600); err != nil {
+		t.Fatal(err)
+	}
+	clock.tick(time.Hour)
+	if err := fs.Chtimes("/f", clock.tick(time.Nanosecond), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	want := times(t, fs, "/f")
+
+	path := filepath.Join(t.TempDir(), "image")
+	if err := memfs.Save(path, fs); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := memfs.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := times(t, loaded, "/f")
+	if !got.btime.Equal(want.btime) || !got.atime.Equal(want.atime) ||
+		!got.mtime.Equal(want.mtime) || !got.ctime.Equal(want.ctime) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+	if got.btime.Equal(got.ctime) {
+		t.Errorf("birth time %v follows change time", got.btime)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 // SplitPath splits path in segments
@@ -21,74 +22,95 @@ func SplitPath(path string) []string {
 	return strings.Split(path, "/")
 }
 
-// find file and its parent in filesystem
-func (fs *MemFS) file(path string) (*File, *File, error) {
-	if strings.HasPrefix(path, "/") { // if path is absolute
-		path = filepath.Clean(path)
-	} else { // convert relative path to absolute
-		path = filepath.Clean(filepath.Join(fs.wd.AbsPath(), path))
+// maxHops - how many symlinks can be followed while resolving a path
+const maxHops = 40
+
+// find file and its parent directory in filesystem,
+// the last path element is not followed if it is a symlink
+func (fs *MemFS) file(path string) (*inode, *File, error) {
+	parent, name, node, err := fs.walk(path, false)
+	if err != nil || node == nil {
+		return parent, nil, err
 	}
-	segs := SplitPath(path)
+	return parent, fs.entryView(parent, name, node), nil
+}
 
-	// handle root directory
-	if len(segs) == 1 {
-		if segs[0] == "" {
-			return nil, fs.root, nil
-		}
-		if segs[0] == "." {
-			return fs.wd.parent, fs.wd, nil
-		}
+// follow is like file but also resolves the last path element
+func (fs *MemFS) follow(path string) (*inode, *File, error) {
+	parent, name, node, err := fs.walk(path, true)
+	if err != nil || node == nil {
+		return parent, nil, err
 	}
+	return parent, fs.entryView(parent, name, node), nil
+}
 
-	// determine root to traverse
-	parent := fs.root
-	if segs[0] == "." {
-		parent = fs.wd
+// entryView makes File for the result of walk
+func (fs *MemFS) entryView(parent *inode, name string, node *inode) *File {
+	if node.dir && (name == "" || name == "." || name == "..") {
+		return fs.dirView(node)
 	}
-	segs = segs[1:]
+	return fs.view(parent, name, node)
+}
 
-	// further directories
-	if len(segs) > 1 {
-		for _, seg := range segs[:len(segs)-1] {
-			if parent.childs == nil {
-				return nil, nil, os.ErrNotExist
-			}
-			if entry, ok := parent.childs[seg]; ok && entry.dir {
-				parent = entry
-			} else {
-				return nil, nil, os.ErrNotExist
-			}
-		}
+// walk resolves path to the directory holding its last element, the element
+// name and its inode, which is nil if the element doesn't exist.
+// Symlinks in the middle of the path are always resolved
+func (fs *MemFS) walk(path string, follow bool) (*inode, string, *inode, error) {
+	if !strings.HasPrefix(path, "/") { // convert relative path to absolute
+		path = filepath.Join(fs.path(fs.wd), path)
 	}
 
-	lastSeg := segs[len(segs)-1]
-	if parent.childs != nil {
-		if node, ok := parent.childs[lastSeg]; ok {
-			return parent, node, nil
+	var (
+		segs   = strings.Split(path, "/")
+		parent = fs.root
+		name   = ""
+		node   = fs.root
+		hops   = 0
+	)
+	for len(segs) > 0 {
+		seg := segs[0]
+		segs = segs[1:]
+		if seg == "" || seg == "." {
+			continue
 		}
-	} else {
-		parent.childs = make(map[string]*File)
-	}
 
-	return parent, nil, nil
-}
+		if node == nil {
+			return nil, "", nil, os.ErrNotExist
+		}
+		if !node.dir {
+			return nil, "", nil, ErrNotDir
+		}
+		if !fs.access(node, mayExec) {
+			return nil, "", nil, os.ErrPermission
+		}
 
-func (fs *MemFS) parseSymlink(name string) (string, bool) {
-	name = filepath.Clean(name)
-	_, f, err := fs.file(name)
-	if err != nil {
-		return "", false
-	}
+		parent, name = node, seg
+		if seg == ".." {
+			node = fs.inode(node.dotdot)
+			parent = fs.inode(node.dotdot)
+			continue
+		}
+		node = fs.child(parent, seg)
 
-	if f == nil {
-		return "", false
-	}
+		// resolve symlink unless it is the last element and shouldn't be followed
+		if node != nil && node.symlink() && (follow || len(segs) > 0) {
+			if hops++; hops > maxHops {
+				return nil, "", nil, syscall.ELOOP
+			}
 
-	var data = make([]byte, 4)
-	if _, err = f.ReadAt(data, 0); err != nil {
-		return "", false
+			target := node.target
+			if strings.HasPrefix(target, "/") {
+				parent, node = fs.root, fs.root
+			} else {
+				node = parent
+			}
+			name = ""
+			segs = append(strings.Split(target, "/"), segs...)
+		}
 	}
 
-	symlink := string(data)
-	return symlink[4:], symlink[:4] == "sym:"
+	if node == fs.root {
+		return nil, "", node, nil
+	}
+	return parent, name, node, nil
 }
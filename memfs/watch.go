@@ -0,0 +1,247 @@
+package memfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Op - kind of change reported to watchers, ops are or-ed into masks
+type Op uint32
+
+// changes reported by Watch
+const (
+	// OpCreate - file, directory, symlink or hard link was added
+	OpCreate Op = 1 << iota
+	// OpWrite - file data was written, truncated or punched
+	OpWrite
+	// OpRemove - directory entry was removed
+	OpRemove
+	// OpRename - entry was moved, OldPath holds its previous path
+	OpRename
+	// OpChmod - mode was changed
+	OpChmod
+	// OpAttrib - owner, times or link count were changed
+	OpAttrib
+	// OpCloseWrite - handle opened for writing was closed
+	OpCloseWrite
+	// OpOverflow - queue of the watcher was full and events were dropped,
+	// it is sent whatever the mask is
+	OpOverflow
+
+	// OpAll - mask of all changes
+	OpAll = OpCreate | OpWrite | OpRemove | OpRename | OpChmod | OpAttrib | OpCloseWrite
+)
+
+// watchQueue - events a watcher holds before it overflows
+const watchQueue = 256
+
+var opNames = []string{"CREATE", "WRITE", "REMOVE", "RENAME", "CHMOD", "ATTRIB", "CLOSE_WRITE", "OVERFLOW"}
+
+// String returns names of ops in op joined with "|"
+func (op Op) String() string {
+	var names []string
+	for i, name := range opNames {
+		if op&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("Op(%d)", uint32(op))
+	}
+	return strings.Join(names, "|")
+}
+
+// Event - change of the filesystem. Paths are absolute
+type Event struct {
+	Op      Op
+	Path    string
+	OldPath string
+}
+
+// String describes the event
+func (e Event) String() string {
+	if e.Op == OpRename {
+		return fmt.Sprintf("%s %s -> %s", e.Op, e.OldPath, e.Path)
+	}
+	return fmt.Sprintf("%s %s", e.Op, e.Path)
+}
+
+// Watcher - watch of a path. Watches are bound to paths rather than
+// files: a watched file replaced by another one is still watched and
+// a watched directory moved away isn't
+type Watcher struct {
+	// Events - queue of changes, closed by Close
+	Events <-chan Event
+
+	fs        *MemFS
+	path      string
+	recursive bool
+	mask      Op
+
+	mu         sync.Mutex
+	ch         chan Event
+	overflowed bool
+	closed     bool
+}
+
+// Watch starts watching name for changes in mask. Changes of a directory
+// include ones of its entries, and of its whole subtree if recursive is
+// set. When the queue is full further events are dropped and OpOverflow
+// is sent, so the watcher knows it has to rescan
+func (fs *MemFS) Watch(name string, recursive bool, mask Op) (*Watcher, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	_, f, err := fs.follow(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: err}
+	}
+	if f == nil {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: os.ErrNotExist}
+	}
+
+	ch := make(chan Event, watchQueue)
+	w := &Watcher{
+		Events:    ch,
+		fs:        fs,
+		path:      fs.entryPath(f.parent, f.name),
+		recursive: recursive,
+		mask:      mask,
+		ch:        ch,
+	}
+
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+	if fs.watchers == nil {
+		fs.watchers = make(map[*Watcher]bool)
+	}
+	fs.watchers[w] = true
+	atomic.StoreInt32(&fs.watching, int32(len(fs.watchers)))
+	return w, nil
+}
+
+// Path returns absolute path being watched
+func (w *Watcher) Path() string {
+	return w.path
+}
+
+// Close stops the watch and closes its queue
+func (w *Watcher) Close() error {
+	w.fs.watchMu.Lock()
+	delete(w.fs.watchers, w)
+	atomic.StoreInt32(&w.fs.watching, int32(len(w.fs.watchers)))
+	w.fs.watchMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return &os.PathError{Op: "close", Path: w.path, Err: os.ErrClosed}
+	}
+	w.closed = true
+	close(w.ch)
+	return nil
+}
+
+// covers checks if changes of path are reported to w
+func (w *Watcher) covers(path string) bool {
+	switch {
+	case path == w.path:
+		return true
+	case w.recursive:
+		return w.path == "/" || strings.HasPrefix(path, w.path+"/")
+	}
+	return filepath.Dir(path) == w.path
+}
+
+// send queues e without blocking, the last slot
+// of the queue is kept for the overflow event
+func (w *Watcher) send(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	if len(w.ch) < cap(w.ch)-1 {
+		w.ch <- e
+		w.overflowed = false
+		return
+	}
+	if !w.overflowed {
+		w.ch <- Event{Op: OpOverflow, Path: w.path}
+		w.overflowed = true
+	}
+}
+
+// entryPath returns absolute path of entry name of parent,
+// parent is nil for the root. Caller holds the tree lock
+func (fs *MemFS) entryPath(parent *inode, name string) string {
+	if parent == nil {
+		return "/"
+	}
+	return filepath.Join(fs.path(parent), name)
+}
+
+// notify reports op on entry name of parent to watchers,
+// caller holds the tree lock
+func (fs *MemFS) notify(op Op, parent *inode, name string) {
+	if atomic.LoadInt32(&fs.watching) == 0 {
+		return
+	}
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+
+	path := fs.entryPath(parent, name)
+	for w := range fs.watchers {
+		if w.mask&op != 0 && w.covers(path) {
+			w.send(Event{Op: op, Path: path})
+		}
+	}
+}
+
+// notifyFile reports op on f to watchers, caller holds the tree lock
+func (fs *MemFS) notifyFile(op Op, f *File) {
+	fs.notify(op, f.parent, f.name)
+}
+
+// notifyRename reports move of oldName of oldParent to newName of
+// newParent to watchers of either path, caller holds the tree lock
+func (fs *MemFS) notifyRename(oldParent *inode, oldName string, newParent *inode, newName string) {
+	if atomic.LoadInt32(&fs.watching) == 0 {
+		return
+	}
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+
+	e := Event{
+		Op:      OpRename,
+		Path:    fs.entryPath(newParent, newName),
+		OldPath: fs.entryPath(oldParent, oldName),
+	}
+	for w := range fs.watchers {
+		if w.mask&OpRename != 0 && (w.covers(e.Path) || w.covers(e.OldPath)) {
+			w.send(e)
+		}
+	}
+}
+
+// overflow tells all watchers to rescan, the whole tree was replaced
+func (fs *MemFS) overflow() {
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+
+	for w := range fs.watchers {
+		w.mu.Lock()
+		if !w.closed && len(w.ch) < cap(w.ch) {
+			w.ch <- Event{Op: OpOverflow, Path: w.path}
+			w.overflowed = true
+		}
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,48 @@
+package memfs_test
+
+import (
+	"testing"
+
+	"fs/memfs"
+)
+
+func TestWatchAddRemove(t *testing.T) {
+	fs := memfs.Create()
+	writeFile(t, fs, "/f", "unwatched")
+
+	// watchers come and go, each one gets changes made while it exists
+	for i := 0; i < 2; i++ {
+		w, err := fs.Watch("/", false, memfs.OpCreate|memfs.OpWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := fs.Watch("/", false, memfs.OpRemove)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fs, "/f", "watched")
+		if err := other.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fs, "/f", "again")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fs, "/f", "unwatched")
+
+		var writes int
+		for e := range w.Events {
+			if e.Op != memfs.OpWrite || e.Path != "/f" {
+				t.Errorf("event %+v", e)
+			}
+			writes++
+		}
+		// truncate and write of the two rewrites made while watched
+		if writes != 4 {
+			t.Errorf("round %d: %d writes reported, want 4", i, writes)
+		}
+		if e, ok := <-other.Events; ok {
+			t.Errorf("event %+v of watcher of removals", e)
+		}
+	}
+}
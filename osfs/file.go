@@ -0,0 +1,132 @@
+package osfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File - host file as listed by the FS, its data is read and written
+// through the FS by path
+type File struct {
+	os.FileInfo
+	fs   *FS
+	path string
+}
+
+// file makes File of path described by info, its ID is remembered
+func (f *FS) file(path string, info os.FileInfo) *File {
+	file := &File{FileInfo: info, fs: f, path: path}
+	f.idMu.Lock()
+	f.ids[file.ID()] = path
+	f.idMu.Unlock()
+	return file
+}
+
+// seen returns file with inode number id if it is still at the path
+// it was seen at
+func (f *FS) seen(id uint64) *File {
+	f.idMu.Lock()
+	path, ok := f.ids[id]
+	f.idMu.Unlock()
+	if !ok {
+		return nil
+	}
+	info, err := os.Lstat(f.host(path))
+	if err != nil {
+		return nil
+	}
+	if file := f.file(path, info); file.ID() == id {
+		return file
+	}
+	return nil
+}
+
+// ID - inode number of the host file
+func (f *File) ID() uint64 {
+	ino, _, _, _ := sysStat(f.FileInfo)
+	return ino
+}
+
+// AbsPath - path of the file inside the FS
+func (f *File) AbsPath() string {
+	return f.path
+}
+
+// Nlink - number of hard links
+func (f *File) Nlink() int {
+	_, nlink, _, _ := sysStat(f.FileInfo)
+	return nlink
+}
+
+// Uid - owner of the file
+func (f *File) Uid() int {
+	_, _, uid, _ := sysStat(f.FileInfo)
+	return uid
+}
+
+// Gid - group of the file
+func (f *File) Gid() int {
+	_, _, _, gid := sysStat(f.FileInfo)
+	return gid
+}
+
+// Truncate changes size of the file
+func (f *File) Truncate(size int) error {
+	return f.fs.Truncate(f.path, size)
+}
+
+// ReadAt reads len(p) bytes at off
+func (f *File) ReadAt(p []byte, off int) (int, error) {
+	h, err := f.fs.open("read", f.path, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	n, err := h.ReadAt(p, int64(off))
+	if err != nil && err != io.EOF {
+		return n, fail("read", f.path, err)
+	}
+	return n, err
+}
+
+// WriteAt writes p at off
+func (f *File) WriteAt(p []byte, off int) (int, error) {
+	h, err := f.fs.open("write", f.path, os.O_WRONLY)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := h.WriteAt(p, int64(off))
+	if err != nil {
+		h.Close()
+		return n, fail("write", f.path, err)
+	}
+	return n, h.Close()
+}
+
+// Close does nothing, no host file is held open
+func (f *File) Close() error {
+	return nil
+}
+
+// open opens existing regular file name of the FS with flag
+func (f *FS) open(op, name string, flag int) (*os.File, error) {
+	f.mu.RLock()
+	path, info, err := f.find(name, true)
+	f.mu.RUnlock()
+	if err != nil {
+		return nil, fail(op, name, err)
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: op, Path: name, Err: fmt.Errorf("%q is a directory", filepath.Base(name))}
+	}
+
+	h, err := os.OpenFile(f.host(path), flag|noFollow, 0)
+	if err != nil {
+		return nil, fail(op, name, err)
+	}
+	return h, nil
+}
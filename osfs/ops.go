@@ -0,0 +1,434 @@
+package osfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	vfs "fs"
+)
+
+// Open opens file for reading and writing, returns its descriptor
+func (f *FS) Open(name string) (int, error) {
+	h, err := f.open("open", name, os.O_RDWR)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for fd, slot := range f.files {
+		if slot == nil {
+			f.files[fd] = h
+			return fd, nil
+		}
+	}
+	f.files = append(f.files, h)
+	return len(f.files) - 1, nil
+}
+
+// handle returns host file of descriptor fd
+func (f *FS) handle(fd int) (*os.File, error) {
+	if fd < 0 || fd >= len(f.files) || f.files[fd] == nil {
+		return nil, os.ErrClosed
+	}
+	return f.files[fd], nil
+}
+
+// Close releases descriptor fd
+func (f *FS) Close(fd int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h, err := f.handle(fd)
+	if err != nil {
+		return err
+	}
+	f.files[fd] = nil
+	for len(f.files) > 0 && f.files[len(f.files)-1] == nil {
+		f.files = f.files[:len(f.files)-1]
+	}
+	return h.Close()
+}
+
+// Read reads size bytes at off of the open file
+func (f *FS) Read(fd, off, size int) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	h, err := f.handle(fd)
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, size)
+	n, err := h.ReadAt(data, int64(off))
+	if err != nil && err != io.EOF {
+		return "", underlying(err)
+	}
+	return string(data[:n]), nil
+}
+
+// Write writes data with specified size at off of the open file
+func (f *FS) Write(fd, off, size int, data string) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	h, err := f.handle(fd)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > size {
+		data = data[:size]
+	}
+	n, err := h.WriteAt([]byte(data), int64(off))
+	if err != nil {
+		return "", underlying(err)
+	}
+	return fmt.Sprintf("%d bytes written to file", n), nil
+}
+
+// Create creates file name, missing directories are made
+func (f *FS) Create(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path, err := f.fresh("create", name)
+	if err != nil {
+		return err
+	}
+	h, err := os.OpenFile(f.host(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fail("create", name, err)
+	}
+	return h.Close()
+}
+
+// Mkdir creates directory name, missing directories are made
+func (f *FS) Mkdir(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path, err := f.fresh("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(f.host(path), 0777); err != nil {
+		return fail("mkdir", name, err)
+	}
+	return nil
+}
+
+// fresh resolves name of a file to be created, directories holding it
+// are made if they are missing
+func (f *FS) fresh(op, name string) (string, error) {
+	path, err := f.resolve(name, false)
+	if os.IsNotExist(err) {
+		// create parent directory if it doesn't exist
+		parent, perr := f.fresh("mkdir", filepath.Dir(f.abs(name)))
+		if perr != nil {
+			return "", perr
+		}
+		if perr := os.Mkdir(f.host(parent), 0777); perr != nil {
+			return "", fail("mkdir", parent, perr)
+		}
+		path, err = f.resolve(name, false)
+	}
+	if err != nil {
+		return "", fail(op, name, err)
+	}
+	if _, err := os.Lstat(f.host(path)); err == nil {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	return path, nil
+}
+
+// Cd changes working directory
+func (f *FS) Cd(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, info, err := f.find(path, true)
+	if err != nil {
+		return fail("cd", path, err)
+	}
+	if err := isDir(info); err != nil {
+		return &os.PathError{Op: "cd", Path: path, Err: err}
+	}
+	f.wd = dir
+	return nil
+}
+
+// Pwd returns working directory
+func (f *FS) Pwd() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.wd
+}
+
+// List returns files of the working directory
+func (f *FS) List() []vfs.File {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	infos, err := ioutil.ReadDir(f.host(f.wd))
+	if err != nil {
+		return nil
+	}
+	files := make([]vfs.File, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, f.file(filepath.Join(f.wd, info.Name()), info))
+	}
+	return files
+}
+
+// Stat returns file with inode number id. Files seen before are looked
+// up at their paths, others are searched in the working directory first
+// and then in the whole tree, remembering files walked by
+func (f *FS) Stat(id int) (vfs.File, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if file := f.seen(uint64(id)); file != nil {
+		return file, nil
+	}
+
+	var found *File
+	search := func(dir string) {
+		filepath.Walk(f.host(dir), func(host string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(f.root, host)
+			if file := f.file(filepath.Join("/", rel), info); file.ID() == uint64(id) {
+				found = file
+				// any error stops the walk
+				return io.EOF
+			}
+			return nil
+		})
+	}
+	if search(f.wd); found == nil {
+		search("/")
+	}
+	if found == nil {
+		return nil, fmt.Errorf("file with id %d doesn't exist", id)
+	}
+	return found, nil
+}
+
+// Lstat returns stats of name, symlink itself is described
+func (f *FS) Lstat(name string) (os.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, info, err := f.find(name, false)
+	if err != nil {
+		return nil, fail("lstat", name, err)
+	}
+	return f.file(path, info), nil
+}
+
+// Cat returns data of file name
+func (f *FS) Cat(name string) (string, error) {
+	h, err := f.open("cat", name, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer h.Close()
+
+	data, err := ioutil.ReadAll(h)
+	if err != nil {
+		return "", fail("cat", name, err)
+	}
+	return string(data), nil
+}
+
+// Readlink returns destination of symlink name as it was written
+func (f *FS) Readlink(name string) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, err := f.resolve(name, false)
+	if err != nil {
+		return "", fail("readlink", name, err)
+	}
+	target, err := os.Readlink(f.host(path))
+	if err != nil {
+		return "", fail("readlink", name, err)
+	}
+	return target, nil
+}
+
+// Symlink creates newname as symlink to oldname. Absolute oldname
+// starts at the root of the FS, not the host one
+func (f *FS) Symlink(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path, err := f.fresh("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(oldname, f.host(path)); err != nil {
+		return fail("symlink", newname, err)
+	}
+	return nil
+}
+
+// Link creates hard link name2 to name1
+func (f *FS) Link(name1, name2 string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	src, info, err := f.find(name1, false)
+	if err != nil {
+		return fail("link", name1, err)
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "link", Path: name1, Err: syscall.EPERM}
+	}
+	dst, err := f.fresh("link", name2)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(f.host(src), f.host(dst)); err != nil {
+		return &os.LinkError{Op: "link", Old: name1, New: name2, Err: underlying(err)}
+	}
+	return nil
+}
+
+// Rename moves oldname to newname replacing it
+func (f *FS) Rename(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	src, _, err := f.find(oldname, false)
+	if err == nil && src == "/" {
+		err = syscall.EBUSY
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	dst, err := f.resolve(newname, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if err := os.Rename(f.host(src), f.host(dst)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: underlying(err)}
+	}
+	return nil
+}
+
+// Truncate changes size of file name
+func (f *FS) Truncate(name string, size int) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, info, err := f.find(name, true)
+	if err != nil {
+		return fail("truncate", name, err)
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+	if err := os.Truncate(f.host(path), int64(size)); err != nil {
+		return fail("truncate", name, err)
+	}
+	return nil
+}
+
+// Chmod changes mode of file name
+func (f *FS) Chmod(name string, mode os.FileMode) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, _, err := f.find(name, true)
+	if err == nil {
+		err = os.Chmod(f.host(path), mode)
+	}
+	if err != nil {
+		return fail("chmod", name, err)
+	}
+	return nil
+}
+
+// Chown changes owner and group of file name, -1 keeps the value
+func (f *FS) Chown(name string, uid, gid int) error {
+	return f.chown("chown", name, uid, gid, true)
+}
+
+// Lchown changes owner and group of file name, symlink itself is changed
+func (f *FS) Lchown(name string, uid, gid int) error {
+	return f.chown("lchown", name, uid, gid, false)
+}
+
+func (f *FS) chown(op, name string, uid, gid int, follow bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, _, err := f.find(name, follow)
+	if err == nil {
+		err = os.Lchown(f.host(path), uid, gid)
+	}
+	if err != nil {
+		return fail(op, name, err)
+	}
+	return nil
+}
+
+// Chtimes changes access and modification times of file name
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path, _, err := f.find(name, true)
+	if err == nil {
+		err = os.Chtimes(f.host(path), atime, mtime)
+	}
+	if err != nil {
+		return fail("chtimes", name, err)
+	}
+	return nil
+}
+
+// Unlink removes file name
+func (f *FS) Unlink(name string) error {
+	return f.remove("unlink", name, false)
+}
+
+// Remove removes file name
+func (f *FS) Remove(name string) error {
+	return f.remove("remove", name, false)
+}
+
+// RemoveDir removes empty directory name
+func (f *FS) RemoveDir(name string) error {
+	return f.remove("rmdir", name, true)
+}
+
+// remove removes file or directory name
+func (f *FS) remove(op, name string, dir bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path, info, err := f.find(name, false)
+	if err != nil {
+		return fail(op, name, err)
+	}
+	if info.IsDir() != dir {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if path == "/" || path == f.wd {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EBUSY}
+	}
+	if err := os.Remove(f.host(path)); err != nil {
+		return fail(op, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package osfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// maxHops - how many symlinks can be followed while resolving a path
+const maxHops = 40
+
+// FS - filesystem passing operations through to a host directory.
+//
+// Paths are confined to the root like in a chroot: ".." stops at the root
+// and symlinks are resolved by FS itself, absolute targets starting at the
+// root, so no path made through the FS leads out of it.
+//
+// The confinement is best-effort against other host processes. A path is
+// resolved first and then used by the host, only its last element is
+// opened with O_NOFOLLOW. A process swapping a directory of the path for a
+// symlink in between can redirect the operation outside of the root, so
+// don't use FS on directories writable by untrusted host users
+type FS struct {
+	mu    sync.RWMutex
+	root  string
+	wd    string
+	files []*os.File
+
+	// ids maps inode numbers of files seen by listings, lookups
+	// and walks to their paths, Stat checks it before walking
+	idMu sync.Mutex
+	ids  map[uint64]string
+}
+
+// New creates FS of host directory root
+func New(root string) (*FS, error) {
+	abs, err := filepath.Abs(root)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "new", Path: root, Err: underlying(err)}
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, &os.PathError{Op: "new", Path: root, Err: underlying(err)}
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "new", Path: root, Err: syscall.ENOTDIR}
+	}
+	return &FS{root: abs, wd: "/", ids: make(map[uint64]string)}, nil
+}
+
+// Root returns the host directory
+func (f *FS) Root() string {
+	return f.root
+}
+
+// abs makes name absolute against the working directory,
+// cleaning can't take it above the root
+func (f *FS) abs(name string) string {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(f.wd, name)
+	}
+	return filepath.Clean("/" + name)
+}
+
+// host returns host path of cleaned absolute path
+func (f *FS) host(path string) string {
+	return filepath.Join(f.root, path)
+}
+
+// resolve returns absolute path of name with symlinks resolved inside
+// the root. Symlinks in the middle of the path are followed, the last one
+// only if follow is set. Missing last element is fine, the caller tells
+// if the file has to exist
+func (f *FS) resolve(name string, follow bool) (string, error) {
+	path := f.abs(name)
+	for hops := 0; ; hops++ {
+		if hops > maxHops {
+			return "", syscall.ELOOP
+		}
+
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		cur, link := "/", false
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			next := filepath.Join(cur, part)
+			last := i == len(parts)-1
+
+			info, err := os.Lstat(f.host(next))
+			if err != nil {
+				if last && os.IsNotExist(err) {
+					return next, nil
+				}
+				return "", underlying(err)
+			}
+			if info.Mode()&os.ModeSymlink != 0 && (!last || follow) {
+				target, err := os.Readlink(f.host(next))
+				if err != nil {
+					return "", underlying(err)
+				}
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(cur, target)
+				}
+				path = filepath.Clean("/" + filepath.Join(append([]string{target}, parts[i+1:]...)...))
+				link = true
+				break
+			}
+			if !last && !info.IsDir() {
+				return "", syscall.ENOTDIR
+			}
+			cur = next
+		}
+		if !link {
+			return cur, nil
+		}
+	}
+}
+
+// find resolves name of an existing file, returns its path and stats
+func (f *FS) find(name string, follow bool) (string, os.FileInfo, error) {
+	path, err := f.resolve(name, follow)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(f.host(path))
+	if err != nil {
+		return "", nil, underlying(err)
+	}
+	return path, info, nil
+}
+
+// fail wraps error of host operation op with the name it was given,
+// so host paths don't show up in errors
+func fail(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: underlying(err)}
+}
+
+// underlying strips host path from os errors
+func underlying(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return err
+}
+
+// isDir returns error unless info is a directory
+func isDir(info os.FileInfo) error {
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package osfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"fs/memfs"
+	"fs/osfs"
+)
+
+// filesystem - operations both MemFS and FS have
+type filesystem interface {
+	Open(name string) (int, error)
+	Write(fd, off, size int, data string) (string, error)
+	Close(fd int) error
+	Create(name string) error
+	Mkdir(name string) error
+	Cd(path string) error
+	Pwd() string
+	Cat(name string) (string, error)
+	Lstat(name string) (os.FileInfo, error)
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Rename(oldname, newname string) error
+	Truncate(name string, size int) error
+	Remove(name string) error
+	RemoveDir(name string) error
+}
+
+// kind names error class of err, so errors of both filesystems compare
+func kind(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.ENOENT, syscall.EEXIST, syscall.ENOTDIR, syscall.EISDIR,
+		syscall.ENOTEMPTY, syscall.ELOOP, syscall.EBUSY,
+	} {
+		if errors.Is(err, errno) {
+			return errno.Error()
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return syscall.ENOENT.Error()
+	}
+	if errors.Is(err, os.ErrExist) {
+		return syscall.EEXIST.Error()
+	}
+	if errors.Is(err, memfs.ErrNotDir) {
+		return syscall.ENOTDIR.Error()
+	}
+	return "error"
+}
+
+// step - operation run on both filesystems, its result is compared
+type step struct {
+	name string
+	fn   func(fs filesystem) (string, error)
+}
+
+func cat(name string) step {
+	return step{"cat " + name, func(fs filesystem) (string, error) {
+		return fs.Cat(name)
+	}}
+}
+
+func do(name string, fn func(fs filesystem) error) step {
+	return step{name, func(fs filesystem) (string, error) {
+		return "", fn(fs)
+	}}
+}
+
+func write(name, data string) step {
+	return do("write "+name, func(fs filesystem) error {
+		fd, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+		if _, err := fs.Write(fd, 0, len(data), data); err != nil {
+			fs.Close(fd)
+			return err
+		}
+		return fs.Close(fd)
+	})
+}
+
+func TestSameAsMemFS(t *testing.T) {
+	top := t.TempDir()
+	secret := filepath.Join(top, "secret")
+	if err := os.WriteFile(secret, []byte("host secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(top, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	host, err := osfs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []step{
+		do("mkdir /a", func(fs filesystem) error { return fs.Mkdir("/a") }),
+		do("create /a/f", func(fs filesystem) error { return fs.Create("/a/f") }),
+		write("/a/f", "data"),
+		cat("/a/f"),
+		do("create /a/f again", func(fs filesystem) error { return fs.Create("/a/f") }),
+		cat("/a/missing"),
+		do("mkdir through file", func(fs filesystem) error { return fs.Mkdir("/a/f/d") }),
+
+		// ".." stops at the root
+		cat("/../secret"),
+		cat("/../../../root/a/f"),
+		do("cd /a", func(fs filesystem) error { return fs.Cd("/a") }),
+		cat("../../secret"),
+		cat("../../a/f"),
+		do("cd ../../..", func(fs filesystem) error { return fs.Cd("../../..") }),
+		{"pwd", func(fs filesystem) (string, error) { return fs.Pwd(), nil }},
+		do("create /../outside", func(fs filesystem) error { return fs.Create("/../outside") }),
+		cat("/outside"),
+
+		// symlinks are resolved inside the root
+		do("symlink up", func(fs filesystem) error { return fs.Symlink("../../secret", "/a/up") }),
+		{"readlink up", func(fs filesystem) (string, error) { return fs.Readlink("/a/up") }},
+		cat("/a/up"),
+		do("symlink to host path", func(fs filesystem) error { return fs.Symlink(secret, "/abs") }),
+		cat("/abs"),
+		do("symlink to parent", func(fs filesystem) error { return fs.Symlink("../..", "/a/top") }),
+		cat("/a/top/secret"),
+		cat("/a/top/a/f"),
+		cat("/a/top/a/top/a/top/a/f"),
+		do("symlink to root", func(fs filesystem) error { return fs.Symlink("/", "/a/slash") }),
+		cat("/a/slash/../secret"),
+		do("write through escaping link", func(fs filesystem) error { return fs.Create("/a/top/escaped") }),
+		cat("/escaped"),
+		do("loop", func(fs filesystem) error { return fs.Symlink("/loop", "/loop") }),
+		cat("/loop"),
+
+		// changes
+		do("truncate", func(fs filesystem) error { return fs.Truncate("/a/f", 2) }),
+		cat("/a/f"),
+		do("rename", func(fs filesystem) error { return fs.Rename("/a/f", "/g") }),
+		cat("/g"),
+		cat("/a/f"),
+		do("remove dir as file", func(fs filesystem) error { return fs.Remove("/a") }),
+		do("rmdir not empty", func(fs filesystem) error { return fs.RemoveDir("/a") }),
+		do("rmdir root", func(fs filesystem) error { return fs.RemoveDir("/") }),
+		do("remove link", func(fs filesystem) error { return fs.Remove("/a/up") }),
+		{"lstat link to parent", func(fs filesystem) (string, error) {
+			info, err := fs.Lstat("/a/top")
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprint(info.Mode()&os.ModeType == os.ModeSymlink), nil
+		}},
+	}
+
+	mem := memfs.Create()
+	for _, s := range steps {
+		want, werr := s.fn(mem)
+		got, gerr := s.fn(host)
+		if got != want || kind(gerr) != kind(werr) {
+			t.Errorf("%s: osfs %q, %v; memfs %q, %v", s.name, got, gerr, want, werr)
+		}
+	}
+
+	// nothing left the root and the host file is untouched
+	entries, err := os.ReadDir(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[root secret]" {
+		t.Errorf("host directory holds %v", names)
+	}
+	if data, err := os.ReadFile(secret); err != nil || string(data) != "host secret" {
+		t.Errorf("host file: %q, %v", data, err)
+	}
+}
+
+func TestStatID(t *testing.T) {
+	fs, err := osfs.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a/b/f", "/a/g"} {
+		if err := fs.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := fs.Lstat("/a/b/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := info.(interface{ ID() uint64 }).ID()
+
+	f, err := fs.Stat(int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := f.(*osfs.File).AbsPath(); path != "/a/b/f" {
+		t.Errorf("stat %d: %s", id, path)
+	}
+
+	// moved file is found again at its new path
+	if err := fs.Rename("/a/b/f", "/h"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Stat(int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := f.(*osfs.File).AbsPath(); path != "/h" {
+		t.Errorf("stat %d after rename: %s", id, path)
+	}
+
+	if err := fs.Remove("/h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(int(id)); err == nil {
+		t.Errorf("stat %d of removed file succeeded", id)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package osfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// noFollow - open flag refusing symlink as the last element
+const noFollow = syscall.O_NOFOLLOW
+
+// sysStat returns inode number, links count, owner and group of info
+func sysStat(info os.FileInfo) (ino uint64, nlink, uid, gid int) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 1, 0, 0
+	}
+	return uint64(st.Ino), int(st.Nlink), int(st.Uid), int(st.Gid)
+}
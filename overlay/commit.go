@@ -0,0 +1,157 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	vfs "fs"
+	"fs/memfs"
+)
+
+// Commit merges the upper layer into the lower one and empties it,
+// the overlay shows the same tree afterwards. Whiteouts remove lower
+// entries, opaque directories drop their lower contents and upper files
+// replace lower ones. Fails with EBUSY while files are open.
+// It isn't atomic: the lower layer is changed entry by entry and a failure,
+// e.g. ENOSPC, leaves it partly committed, as other overlays of it see.
+// The upper layer is emptied only once all of it is merged, so the overlay
+// still shows the same tree and Commit can be retried
+func (o *FS) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, f := range o.files {
+		if f != nil {
+			return &os.PathError{Op: "commit", Path: "/", Err: syscall.EBUSY}
+		}
+	}
+
+	root, err := o.upper.Lstat("/")
+	if err != nil {
+		return err
+	}
+	c := &committer{lower: privileged(o.lower), upper: o.upper, links: make(map[uint64]string)}
+	if err := c.merge("/"); err != nil {
+		return err
+	}
+	if err := copyAttrs(c.lower, "/", root); err != nil {
+		return err
+	}
+	return clear(privileged(o.upper), "/")
+}
+
+// committer - state of a Commit walk, links maps IDs of upper files
+// having hard links to the first lower path they were copied to
+type committer struct {
+	lower *memfs.MemFS
+	upper *memfs.MemFS
+	links map[uint64]string
+}
+
+// merge copies upper directory path into the lower layer
+func (c *committer) merge(path string) error {
+	entries, err := c.upper.IOFS().ReadDir(iopath(path))
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		if d.Name() == opaqueMarker {
+			if err := clear(c.lower, path); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for _, d := range entries {
+		name := d.Name()
+		if name == opaqueMarker {
+			continue
+		}
+		if reserved(name) {
+			lower := filepath.Join(path, name[len(whiteoutPrefix):])
+			if info := lstat(c.lower, lower); info != nil {
+				if err := removeAll(c.lower, lower, info); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		p := filepath.Join(path, name)
+		info := lstat(c.upper, p)
+		if info == nil {
+			continue
+		}
+		if err := c.put(p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put copies upper file path described by info to the lower layer,
+// replacing the lower entry unless both are directories
+func (c *committer) put(path string, info os.FileInfo) error {
+	lower := lstat(c.lower, path)
+	if lower != nil && !(lower.IsDir() && info.IsDir()) {
+		if err := removeAll(c.lower, path, lower); err != nil {
+			return err
+		}
+		lower = nil
+	}
+
+	if info.IsDir() {
+		if lower == nil {
+			if err := c.lower.Mkdir(path); err != nil {
+				return err
+			}
+		}
+		if err := c.merge(path); err != nil {
+			return err
+		}
+		// times are set last, merging the entries changes them
+		return copyAttrs(c.lower, path, info)
+	}
+
+	// hard links within the upper layer stay linked
+	if n, ok := info.(interface{ Nlink() int }); ok && n.Nlink() > 1 && !isSymlink(info) {
+		id := info.(vfs.FileInfo).ID()
+		if first, ok := c.links[id]; ok {
+			return c.lower.Link(first, path)
+		}
+		c.links[id] = path
+	}
+	return copyFile(c.upper, c.lower, path, info)
+}
+
+// clear removes all entries of directory path in layer
+func clear(layer *memfs.MemFS, path string) error {
+	entries, err := layer.IOFS().ReadDir(iopath(path))
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		p := filepath.Join(path, d.Name())
+		info := lstat(layer, p)
+		if info == nil {
+			continue
+		}
+		if err := removeAll(layer, p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes path of layer with everything it holds
+func removeAll(layer *memfs.MemFS, path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return layer.Remove(path)
+	}
+	if err := clear(layer, path); err != nil {
+		return err
+	}
+	return layer.RemoveDir(path)
+}
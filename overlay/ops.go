@@ -0,0 +1,607 @@
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	vfs "fs"
+	"fs/memfs"
+)
+
+// listed - file of a directory listing, named as listed
+// and with ID telling its layer
+type listed struct {
+	*memfs.File
+	name string
+	id   uint64
+}
+
+// Name of the file
+func (f *listed) Name() string {
+	return f.name
+}
+
+// ID of the file, lower layer IDs have LowerID bit set
+func (f *listed) ID() uint64 {
+	return f.id
+}
+
+// Open opens file for reading and writing, returns its descriptor.
+// A lower file is copied up on the first write
+func (o *FS) Open(name string) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.find(name, true)
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if e.info().IsDir() {
+		return 0, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("%q is a directory", filepath.Base(name))}
+	}
+
+	f := &file{path: e.path, copied: e.upper != nil}
+	if f.copied {
+		f.h, err = o.upper.OpenFile(e.path, os.O_RDWR, 0)
+	} else {
+		f.h, err = o.lower.OpenFile(e.path, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for fd, slot := range o.files {
+		if slot == nil {
+			o.files[fd] = f
+			return fd, nil
+		}
+	}
+	o.files = append(o.files, f)
+	return len(o.files) - 1, nil
+}
+
+// file returns open file of descriptor fd
+func (o *FS) file(fd int) (*file, error) {
+	if fd < 0 || fd >= len(o.files) || o.files[fd] == nil {
+		return nil, os.ErrClosed
+	}
+	return o.files[fd], nil
+}
+
+// Close releases descriptor fd
+func (o *FS) Close(fd int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, err := o.file(fd)
+	if err != nil {
+		return err
+	}
+	o.files[fd] = nil
+	for len(o.files) > 0 && o.files[len(o.files)-1] == nil {
+		o.files = o.files[:len(o.files)-1]
+	}
+	return f.h.Close()
+}
+
+// Read reads size bytes at off of the open file
+func (o *FS) Read(fd, off, size int) (string, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	f, err := o.file(fd)
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, size)
+	n, err := f.h.ReadAt(data, int64(off))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(data[:n]), nil
+}
+
+// Write writes data at off of the open file, copying it up first
+func (o *FS) Write(fd, off, size int, data string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, err := o.file(fd)
+	if err != nil {
+		return "", err
+	}
+	if !f.copied {
+		e, err := o.find(f.path, false)
+		if err != nil {
+			return "", err
+		}
+		if err := o.copyUp(e); err != nil {
+			return "", err
+		}
+		if err := o.moveUp(f.path); err != nil {
+			return "", err
+		}
+	}
+
+	if len(data) > size {
+		data = data[:size]
+	}
+	n, err := f.h.WriteAt([]byte(data), int64(off))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d bytes written to file", n), nil
+}
+
+// moveUp points open files of path copied up to the upper file
+func (o *FS) moveUp(path string) error {
+	for _, f := range o.files {
+		if f == nil || f.copied || f.path != path {
+			continue
+		}
+		h, err := o.upper.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		f.h.Close()
+		f.h, f.copied = h, true
+	}
+	return nil
+}
+
+// Create creates file name, missing directories are made
+func (o *FS) Create(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.fresh("create", name)
+	if err != nil {
+		return err
+	}
+	hides, err := o.prepare(e)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	if err := o.upper.Create(e.path); err != nil {
+		return err
+	}
+	if hides {
+		return o.unhide(e.path)
+	}
+	return nil
+}
+
+// Mkdir creates directory name, missing directories are made
+func (o *FS) Mkdir(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.fresh("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return o.mkdir(e)
+}
+
+// mkdir makes directory e, it is opaque if it replaces a lower entry
+func (o *FS) mkdir(e *entry) error {
+	hides, err := o.prepare(e)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: e.path, Err: err}
+	}
+	if err := o.upper.Mkdir(e.path); err != nil {
+		return err
+	}
+	if !hides {
+		return nil
+	}
+	if err := o.unhide(e.path); err != nil {
+		return err
+	}
+	return o.opaque(e.path)
+}
+
+// fresh resolves name of a file to be created, directories holding it
+// are made if they are missing
+func (o *FS) fresh(op, name string) (*entry, error) {
+	if reserved(filepath.Base(name)) {
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+
+	e, err := o.resolve(name, false)
+	if os.IsNotExist(err) {
+		// create parent directory if it doesn't exist
+		parent, perr := o.fresh("mkdir", filepath.Dir(o.abs(name)))
+		if perr != nil {
+			return nil, perr
+		}
+		if perr := o.mkdir(parent); perr != nil {
+			return nil, perr
+		}
+		e, err = o.resolve(name, false)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if e.exists() {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	return e, nil
+}
+
+// Cd changes working directory
+func (o *FS) Cd(path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.find(path, true)
+	if err != nil {
+		return &os.PathError{Op: "cd", Path: path, Err: err}
+	}
+	if !e.info().IsDir() {
+		return &os.PathError{Op: "cd", Path: path, Err: fmt.Errorf("not a directory")}
+	}
+	o.wd = e.path
+	return nil
+}
+
+// Pwd returns working directory
+func (o *FS) Pwd() string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.wd
+}
+
+// List returns files of the working directory merged from both layers
+func (o *FS) List() []vfs.File {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	e, err := o.find(o.wd, true)
+	if err != nil {
+		return nil
+	}
+	names, err := o.names(e)
+	if err != nil {
+		return nil
+	}
+
+	// each layer is listed once, files are picked from the listings
+	listings := make(map[*memfs.MemFS]map[string]*memfs.File)
+	files := make([]vfs.File, 0, len(names))
+	for name, layer := range names {
+		listing, ok := listings[layer]
+		if !ok {
+			listing = list(layer, e.path)
+			listings[layer] = listing
+		}
+		f := listing[name]
+		if f == nil {
+			continue
+		}
+		id := f.ID()
+		if layer == o.lower {
+			id |= LowerID
+		}
+		files = append(files, &listed{File: f, name: name, id: id})
+	}
+	return files
+}
+
+// list returns files of directory path in layer by name
+func list(layer *memfs.MemFS, path string) map[string]*memfs.File {
+	files, err := layer.ListDir(path)
+	if err != nil {
+		return nil
+	}
+	listing := make(map[string]*memfs.File, len(files))
+	for _, f := range files {
+		listing[f.Name()] = f.(*memfs.File)
+	}
+	return listing
+}
+
+// Stat returns file id, lower layer IDs have LowerID bit set
+func (o *FS) Stat(id int) (vfs.File, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	if id&LowerID != 0 {
+		return o.lower.Stat(id &^ LowerID)
+	}
+	return o.upper.Stat(id)
+}
+
+// Lstat returns stats of name taken from the layer holding it
+func (o *FS) Lstat(name string) (os.FileInfo, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	e, err := o.find(name, false)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return e.info(), nil
+}
+
+// Cat returns data of file name
+func (o *FS) Cat(name string) (string, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	e, err := o.find(name, true)
+	if err != nil {
+		return "", &os.PathError{Op: "cat", Path: name, Err: err}
+	}
+	return o.layer(e).Cat(e.path)
+}
+
+// Readlink returns destination of symlink name
+func (o *FS) Readlink(name string) (string, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	e, err := o.find(name, false)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return o.layer(e).Readlink(e.path)
+}
+
+// Symlink creates newname as symlink to oldname
+func (o *FS) Symlink(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.fresh("symlink", newname)
+	if err != nil {
+		return err
+	}
+	hides, err := o.prepare(e)
+	if err != nil {
+		return &os.PathError{Op: "symlink", Path: newname, Err: err}
+	}
+	if err := o.upper.Symlink(oldname, e.path); err != nil {
+		return err
+	}
+	if hides {
+		return o.unhide(e.path)
+	}
+	return nil
+}
+
+// Link creates hard link name2 to name1, a lower file is copied up
+// and the link is made to the copy
+func (o *FS) Link(name1, name2 string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	src, err := o.find(name1, false)
+	if err != nil {
+		return &os.PathError{Op: "link", Path: name1, Err: err}
+	}
+	dst, err := o.fresh("link", name2)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(src); err != nil {
+		return &os.PathError{Op: "link", Path: name1, Err: err}
+	}
+	hides, err := o.prepare(dst)
+	if err != nil {
+		return &os.PathError{Op: "link", Path: name2, Err: err}
+	}
+	if err := o.upper.Link(src.path, dst.path); err != nil {
+		return err
+	}
+	if hides {
+		return o.unhide(dst.path)
+	}
+	return nil
+}
+
+// change copies file name up for op changing it
+func (o *FS) change(op, name string, follow bool) (*entry, error) {
+	e, err := o.find(name, follow)
+	if err == nil {
+		err = o.copyUp(e)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return e, nil
+}
+
+// Truncate changes size of file name
+func (o *FS) Truncate(name string, size int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.change("truncate", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Truncate(e.path, size)
+}
+
+// Chmod changes mode of file name
+func (o *FS) Chmod(name string, mode os.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.change("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chmod(e.path, mode)
+}
+
+// Chown changes owner and group of file name
+func (o *FS) Chown(name string, uid, gid int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.change("chown", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chown(e.path, uid, gid)
+}
+
+// Unlink removes file name
+func (o *FS) Unlink(name string) error {
+	return o.remove("unlink", name, false)
+}
+
+// Remove removes file name
+func (o *FS) Remove(name string) error {
+	return o.remove("remove", name, false)
+}
+
+// RemoveDir removes empty directory name
+func (o *FS) RemoveDir(name string) error {
+	return o.remove("rmdir", name, true)
+}
+
+// remove drops the upper file of name and hides the lower one
+func (o *FS) remove(op, name string, dir bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, err := o.find(name, false)
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if e.path == "/" {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EBUSY}
+	}
+	if e.info().IsDir() != dir {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if dir {
+		names, err := o.names(e)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return &os.PathError{Op: op, Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if e.upper != nil {
+		if err := o.drop(e.path, e.upper); err != nil {
+			return err
+		}
+	}
+	if e.shadows() {
+		return o.hide(e.path)
+	}
+	return nil
+}
+
+// drop removes path from the upper layer, whiteouts left in
+// a directory are removed with it
+func (o *FS) drop(path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return o.upper.Remove(path)
+	}
+
+	entries, err := o.upper.IOFS().ReadDir(iopath(path))
+	if err != nil {
+		return err
+	}
+	root := privileged(o.upper)
+	for _, d := range entries {
+		if err := root.Remove(filepath.Join(path, d.Name())); err != nil {
+			return err
+		}
+	}
+	return o.upper.RemoveDir(path)
+}
+
+// Rename moves oldname to newname replacing it. Directories having
+// lower entries can't be moved, like in overlayfs that fails with EXDEV.
+// It isn't atomic: the file is copied up, moved in the upper layer and
+// then the lower one is hidden by a whiteout. If a later step fails,
+// e.g. with ENOSPC, the file is left at newname while the lower one
+// shows again at oldname
+func (o *FS) Rename(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if reserved(filepath.Base(newname)) {
+		return fail(syscall.EINVAL)
+	}
+
+	src, err := o.find(oldname, false)
+	if err != nil {
+		return fail(err)
+	}
+	dst, err := o.resolve(newname, false)
+	if err != nil {
+		return fail(err)
+	}
+	if src.path == dst.path {
+		return nil
+	}
+
+	if src.info().IsDir() {
+		if src.lower != nil {
+			return fail(syscall.EXDEV)
+		}
+		if dst.exists() {
+			if !dst.info().IsDir() {
+				return fail(memfs.ErrNotDir)
+			}
+			names, err := o.names(dst)
+			if err != nil {
+				return fail(err)
+			}
+			if len(names) > 0 {
+				return fail(syscall.ENOTEMPTY)
+			}
+		}
+	} else if dst.exists() && dst.info().IsDir() {
+		return fail(memfs.ErrIsDir)
+	}
+
+	if err := o.copyUp(src); err != nil {
+		return fail(err)
+	}
+	// replaced directory goes with its whiteouts
+	if isDir(dst.upper) {
+		if err := o.drop(dst.path, dst.upper); err != nil {
+			return fail(err)
+		}
+	}
+	hides, err := o.prepare(dst)
+	if err != nil {
+		return fail(err)
+	}
+	if err := o.upper.Rename(src.path, dst.path); err != nil {
+		return err
+	}
+	if hides {
+		if err := o.unhide(dst.path); err != nil {
+			return err
+		}
+	}
+
+	// lower entries stay hidden at both names
+	if src.shadows() {
+		if err := o.hide(src.path); err != nil {
+			return err
+		}
+	}
+	if src.info().IsDir() && (hides || dst.shadows()) {
+		return o.opaque(dst.path)
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package overlay
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"fs/memfs"
+)
+
+// Names of upper layer entries hiding lower ones, like aufs uses.
+// They are never listed and can't be created through the overlay
+const (
+	// whiteoutPrefix - upper entry ".wh.name" hides lower entry name
+	whiteoutPrefix = ".wh."
+	// opaqueMarker - upper directory holding it hides the lower one
+	opaqueMarker = ".wh..wh..opq"
+)
+
+// LowerID - bit set in IDs of files listed from the lower layer,
+// so they don't clash with upper ones
+const LowerID = 1 << 62
+
+// maxHops - how many symlinks can be followed while resolving a path
+const maxHops = 40
+
+// FS - union of a read-only lower MemFS and a writable upper MemFS.
+// Reads go to the upper file if there is one and to the lower one
+// otherwise, a lower file is copied up before its first change.
+// Removed lower entries are hidden by whiteouts and directories
+// made anew over them are opaque. The upper layer belongs to the overlay,
+// the lower one is only read until Commit, so many overlays may share it
+type FS struct {
+	mu    sync.RWMutex
+	lower *memfs.MemFS
+	upper *memfs.MemFS
+	wd    string
+	files []*file
+}
+
+// file - open file of the overlay, its handle moves to the upper layer
+// on the first write
+type file struct {
+	path   string
+	h      *memfs.Handle
+	copied bool
+}
+
+// New creates overlay of upper over lower
+func New(lower, upper *memfs.MemFS) *FS {
+	return &FS{lower: lower, upper: upper, wd: "/"}
+}
+
+// Lower returns the lower layer
+func (o *FS) Lower() *memfs.MemFS {
+	return o.lower
+}
+
+// Upper returns the upper layer
+func (o *FS) Upper() *memfs.MemFS {
+	return o.upper
+}
+
+// entry - path resolved in both layers, lower is set if the lower
+// file is visible through the overlay, covers if the upper file hides it
+type entry struct {
+	path   string
+	upper  os.FileInfo
+	lower  os.FileInfo
+	covers bool
+}
+
+// exists checks if entry is visible
+func (e *entry) exists() bool {
+	return e.upper != nil || e.lower != nil
+}
+
+// info returns stats of the visible file
+func (e *entry) info() os.FileInfo {
+	if e.upper != nil {
+		return e.upper
+	}
+	return e.lower
+}
+
+// layer returns layer holding the visible file
+func (o *FS) layer(e *entry) *memfs.MemFS {
+	if e.upper != nil {
+		return o.upper
+	}
+	return o.lower
+}
+
+// abs makes name absolute against the working directory
+func (o *FS) abs(name string) string {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(o.wd, name)
+	}
+	return filepath.Clean(name)
+}
+
+// lstat returns stats of path in layer, nil if it doesn't exist
+func lstat(layer *memfs.MemFS, path string) os.FileInfo {
+	info, err := layer.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// isDir checks if info is a directory
+func isDir(info os.FileInfo) bool {
+	return info != nil && info.IsDir()
+}
+
+// isSymlink checks if info is a symlink
+func isSymlink(info os.FileInfo) bool {
+	return info != nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// reserved checks if name is a whiteout or opaque marker
+func reserved(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// whiteout - path of the whiteout of path
+func whiteout(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, whiteoutPrefix+name)
+}
+
+// root resolves the root directory
+func (o *FS) root() *entry {
+	e := &entry{path: "/", upper: lstat(o.upper, "/"), lower: lstat(o.lower, "/")}
+	if lstat(o.upper, filepath.Join("/", opaqueMarker)) != nil {
+		e.lower = nil
+	}
+	return e
+}
+
+// child resolves entry name of directory dir
+func (o *FS) child(dir *entry, name string) *entry {
+	e := &entry{path: filepath.Join(dir.path, name)}
+	if reserved(name) {
+		return e
+	}
+	if isDir(dir.upper) {
+		e.upper = lstat(o.upper, e.path)
+	}
+	if isDir(dir.lower) && lstat(o.upper, whiteout(e.path)) == nil {
+		e.lower = lstat(o.lower, e.path)
+	}
+
+	// upper file hides the lower one, upper directory is merged with
+	// a lower one unless it is opaque
+	if e.upper != nil && e.lower != nil {
+		if !e.upper.IsDir() || !e.lower.IsDir() || lstat(o.upper, filepath.Join(e.path, opaqueMarker)) != nil {
+			e.lower, e.covers = nil, true
+		}
+	}
+	return e
+}
+
+// shadows checks if a lower file is at the path of e,
+// it has to be hidden when e goes away
+func (e *entry) shadows() bool {
+	return e.lower != nil || e.covers
+}
+
+// resolve finds name in the layers. Symlinks in the middle of the path
+// are followed, the last one only if follow is set. Missing last element
+// is returned as entry that doesn't exist
+func (o *FS) resolve(name string, follow bool) (*entry, error) {
+	path := o.abs(name)
+	for hops := 0; ; hops++ {
+		if hops > maxHops {
+			return nil, syscall.ELOOP
+		}
+
+		e := o.root()
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		link := false
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			if !e.exists() {
+				return nil, os.ErrNotExist
+			}
+			if !e.info().IsDir() {
+				return nil, syscall.ENOTDIR
+			}
+
+			e = o.child(e, part)
+			last := i == len(parts)-1
+			if isSymlink(e.info()) && (!last || follow) {
+				target, err := o.layer(e).Readlink(e.path)
+				if err != nil {
+					return nil, err
+				}
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(filepath.Dir(e.path), target)
+				}
+				path = filepath.Clean(filepath.Join(append([]string{target}, parts[i+1:]...)...))
+				link = true
+				break
+			}
+		}
+		if !link {
+			return e, nil
+		}
+	}
+}
+
+// find resolves name of an existing file
+func (o *FS) find(name string, follow bool) (*entry, error) {
+	e, err := o.resolve(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if !e.exists() {
+		return nil, os.ErrNotExist
+	}
+	return e, nil
+}
+
+// privileged returns view of layer acting with root credential and
+// no umask, so copies keep modes and owners of the originals.
+// Others using the layer keep acting with its own credential
+func privileged(layer *memfs.MemFS) *memfs.MemFS {
+	return layer.WithCred(memfs.Cred{}, 0)
+}
+
+// copyUp makes sure file of e is in the upper layer,
+// directories holding it are copied up first
+func (o *FS) copyUp(e *entry) error {
+	if e.upper != nil {
+		return nil
+	}
+	if e.lower == nil {
+		return os.ErrNotExist
+	}
+	if e.path != "/" {
+		parent, err := o.find(filepath.Dir(e.path), false)
+		if err != nil {
+			return err
+		}
+		if err := o.copyUp(parent); err != nil {
+			return err
+		}
+	}
+
+	if err := copyFile(o.lower, privileged(o.upper), e.path, e.lower); err != nil {
+		return err
+	}
+	e.upper = lstat(o.upper, e.path)
+	return nil
+}
+
+// copyFile copies file path described by info from src to dst with its
+// mode, owner and times. Directories are copied without entries
+func copyFile(src, dst *memfs.MemFS, path string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if path != "/" {
+			if err := dst.Mkdir(path); err != nil {
+				return err
+			}
+		}
+	case isSymlink(info):
+		target, err := src.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := dst.Symlink(target, path); err != nil {
+			return err
+		}
+	default:
+		if err := copyData(src, dst, path, info.Mode()); err != nil {
+			return err
+		}
+	}
+	return copyAttrs(dst, path, info)
+}
+
+// copyData copies data of regular file path from src to dst
+func copyData(src, dst *memfs.MemFS, path string, mode os.FileMode) error {
+	r, err := src.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// copyAttrs gives file path of dst owner, mode and times of info
+func copyAttrs(dst *memfs.MemFS, path string, info os.FileInfo) error {
+	if owner, ok := info.(interface {
+		Uid() int
+		Gid() int
+	}); ok {
+		if err := dst.Lchown(path, owner.Uid(), owner.Gid()); err != nil {
+			return err
+		}
+	}
+	// symlinks have no mode and times of their own
+	if isSymlink(info) {
+		return nil
+	}
+
+	if err := dst.Chmod(path, info.Mode()); err != nil {
+		return err
+	}
+	var atime time.Time
+	if a, ok := info.(interface{ AccessTime() time.Time }); ok {
+		atime = a.AccessTime()
+	}
+	return dst.Chtimes(path, atime, info.ModTime())
+}
+
+// prepare copies up directories holding e, so an upper entry can be
+// made at it. Returns true if e has a whiteout, it is removed by unhide
+// once the entry is made and a directory made there has to be opaque
+func (o *FS) prepare(e *entry) (bool, error) {
+	parent, err := o.find(filepath.Dir(e.path), false)
+	if err != nil {
+		return false, err
+	}
+	if err := o.copyUp(parent); err != nil {
+		return false, err
+	}
+	return lstat(o.upper, whiteout(e.path)) != nil, nil
+}
+
+// unhide removes whiteout of path replaced by an upper entry
+func (o *FS) unhide(path string) error {
+	return privileged(o.upper).Remove(whiteout(path))
+}
+
+// hide makes whiteout of path in the upper layer. It is made with
+// the caller credential, so it takes the same permission as removing path
+func (o *FS) hide(path string) error {
+	parent, err := o.find(filepath.Dir(path), false)
+	if err == nil {
+		err = o.copyUp(parent)
+	}
+	if err != nil {
+		return err
+	}
+	return o.upper.Create(whiteout(path))
+}
+
+// opaque marks upper directory path as hiding the lower one
+func (o *FS) opaque(path string) error {
+	return privileged(o.upper).Create(filepath.Join(path, opaqueMarker))
+}
+
+// names lists entries of directory e visible through the overlay,
+// mapped to the layer holding them
+func (o *FS) names(e *entry) (map[string]*memfs.MemFS, error) {
+	names := make(map[string]*memfs.MemFS)
+	hidden := make(map[string]bool)
+	if e.upper != nil {
+		entries, err := o.upper.IOFS().ReadDir(iopath(e.path))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range entries {
+			switch name := d.Name(); {
+			case name == opaqueMarker:
+			case reserved(name):
+				hidden[strings.TrimPrefix(name, whiteoutPrefix)] = true
+			default:
+				names[name] = o.upper
+			}
+		}
+	}
+	if e.lower != nil {
+		entries, err := o.lower.IOFS().ReadDir(iopath(e.path))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range entries {
+			if name := d.Name(); names[name] == nil && !hidden[name] {
+				names[name] = o.lower
+			}
+		}
+	}
+	return names, nil
+}
+
+// iopath converts absolute path to the io/fs form
+func iopath(path string) string {
+	if path == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(path, "/")
+}
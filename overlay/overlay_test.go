@@ -0,0 +1,234 @@
+package overlay_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+
+	"fs/memfs"
+	"fs/overlay"
+)
+
+// TestConcurrentCommit commits overlays sharing a lower layer in parallel
+// while the lower layer is used with an unprivileged credential. Commits
+// act as root in their own views, the credential of the lower layer must
+// never change. It is meant to be run with -race
+func TestConcurrentCommit(t *testing.T) {
+	const overlays = 8
+	rounds := 50
+	if testing.Short() {
+		rounds = 10
+	}
+
+	lower := memfs.Create()
+	for i := 0; i < overlays; i++ {
+		if err := lower.Mkdir(fmt.Sprintf("/o%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := memfs.Cred{Uid: 1000, Gid: 1000}
+	lower.SetCred(user)
+	lower.SetUmask(077)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, overlays+1)
+	for i := 0; i < overlays; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := overlay.New(lower, memfs.Create())
+			for r := 0; r < rounds; r++ {
+				name := fmt.Sprintf("/o%d/f%d", i, r)
+				if err := o.Create(name); err != nil {
+					errs <- err
+					return
+				}
+				if err := o.Chmod(name, 0640); err != nil {
+					errs <- err
+					return
+				}
+				if err := o.Commit(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if c := lower.Cred(); c.Uid != user.Uid || c.Gid != user.Gid {
+				errs <- fmt.Errorf("lower layer credential changed to %+v", c)
+				return
+			}
+			if mask := lower.Umask(); mask != 077 {
+				errs <- fmt.Errorf("lower layer umask changed to %o", mask)
+				return
+			}
+			// root directory of the lower layer isn't writable by the user
+			if err := lower.Create("/escalated"); !os.IsPermission(err) {
+				errs <- fmt.Errorf("create in lower root: %v, want permission error", err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-checked
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// commits keep modes set through the overlays
+	for i := 0; i < overlays; i++ {
+		for r := 0; r < rounds; r++ {
+			name := fmt.Sprintf("/o%d/f%d", i, r)
+			info, err := lower.Lstat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0640 {
+				t.Errorf("%s: mode %o, want 640", name, perm)
+			}
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	lower := memfs.Create()
+	for _, name := range []string{"/kept", "/shadowed", "/removed"} {
+		if err := lower.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upper := memfs.Create()
+	o := overlay.New(lower, upper)
+	if err := o.Create("/added"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Chmod("/shadowed", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("/removed"); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range o.List() {
+		names = append(names, f.Name())
+		fromLower := f.ID()&overlay.LowerID != 0
+		switch f.Name() {
+		case "kept":
+			if !fromLower {
+				t.Errorf("%s listed from the upper layer", f.Name())
+			}
+		case "added", "shadowed":
+			if fromLower {
+				t.Errorf("%s listed from the lower layer", f.Name())
+			}
+		}
+		// listed IDs lead back to the same files
+		got, err := o.Stat(int(f.ID()))
+		if err != nil {
+			t.Fatalf("stat %s: %v", f.Name(), err)
+		}
+		if got.Mode() != f.Mode() {
+			t.Errorf("%s: stat mode %v, listed %v", f.Name(), got.Mode(), f.Mode())
+		}
+	}
+	sort.Strings(names)
+	if want := fmt.Sprint([]string{"added", "kept", "shadowed"}); fmt.Sprint(names) != want {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+}
+
+// exist tells which of names fs has
+func exist(fs interface {
+	Lstat(name string) (os.FileInfo, error)
+}, names ...string) string {
+	var found []string
+	for _, name := range names {
+		if _, err := fs.Lstat(name); err == nil {
+			found = append(found, name)
+		}
+	}
+	return fmt.Sprint(found)
+}
+
+func TestCommitFailure(t *testing.T) {
+	// root, /old and two more inodes
+	lower := memfs.Create(memfs.Options{MaxInodes: 3})
+	if err := lower.Create("/old"); err != nil {
+		t.Fatal(err)
+	}
+	o := overlay.New(lower, memfs.Create())
+	if err := o.Remove("/old"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if err := o.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the whiteout and two files are committed before space runs out,
+	// the overlay keeps showing its tree
+	if err := o.Commit(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("commit: %v, want ENOSPC", err)
+	}
+	all := []string{"/old", "/a", "/b", "/c"}
+	if got, want := exist(lower, all...), "[/a /b]"; got != want {
+		t.Errorf("lower layer has %s, want %s", got, want)
+	}
+	if got, want := exist(o, all...), "[/a /b /c]"; got != want {
+		t.Errorf("overlay has %s, want %s", got, want)
+	}
+
+	// once it fits commit is retried
+	if err := o.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := exist(lower, all...), "[/b /c]"; got != want {
+		t.Errorf("lower layer has %s, want %s", got, want)
+	}
+	if got, want := exist(o, all...), "[/b /c]"; got != want {
+		t.Errorf("overlay has %s, want %s", got, want)
+	}
+}
+
+func TestRenameFailure(t *testing.T) {
+	lower := memfs.Create()
+	if err := lower.Create("/f"); err != nil {
+		t.Fatal(err)
+	}
+	// root and the copied up file, no room for the whiteout
+	o := overlay.New(lower, memfs.Create(memfs.Options{MaxInodes: 2}))
+
+	if err := o.Rename("/f", "/g"); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("rename: %v, want ENOSPC", err)
+	}
+	// the file is moved but the lower one isn't hidden
+	if got, want := exist(o, "/f", "/g"), "[/f /g]"; got != want {
+		t.Errorf("overlay has %s, want %s", got, want)
+	}
+	if _, err := lower.Lstat("/f"); err != nil {
+		t.Errorf("lower file: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package sftpd
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"fs/memfs"
+
+	"github.com/pkg/sftp"
+)
+
+// handlers - sftp request server handlers of a MemFS. Paths of requests
+// are absolute, files are opened through the descriptor table of the
+// MemFS and closed by the request server when the client closes them
+type handlers struct {
+	fs *memfs.MemFS
+}
+
+var (
+	_ sftp.FileReader           = (*handlers)(nil)
+	_ sftp.FileWriter           = (*handlers)(nil)
+	_ sftp.OpenFileWriter       = (*handlers)(nil)
+	_ sftp.FileCmder            = (*handlers)(nil)
+	_ sftp.PosixRenameFileCmder = (*handlers)(nil)
+	_ sftp.FileLister           = (*handlers)(nil)
+	_ sftp.LstatFileLister      = (*handlers)(nil)
+	_ sftp.ReadlinkFileLister   = (*handlers)(nil)
+)
+
+// Handlers returns sftp request server handlers of fs
+func Handlers(fs *memfs.MemFS) sftp.Handlers {
+	h := &handlers{fs: fs}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// Fileread opens file for reading
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.open(r)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Filewrite opens file for writing
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := h.open(r)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile opens file for reading and writing
+func (h *handlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.open(r)
+}
+
+// open opens file of r with its SFTP flags, new files are created with
+// mode 0666 masked with umask. Data written to a file opened for append
+// goes to its end whatever offset the client sends, like pwrite does
+// on Linux for a file opened with O_APPEND
+func (h *handlers) open(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	pflags := r.Pflags()
+	var flag int
+	switch {
+	case pflags.Read && pflags.Write:
+		flag = os.O_RDWR
+	case pflags.Write:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	if pflags.Append {
+		flag |= os.O_APPEND
+	}
+
+	f, err := h.fs.OpenFile(r.Filepath, flag, 0666)
+	if err != nil {
+		return nil, status(err)
+	}
+	if pflags.Append {
+		return appender{f}, nil
+	}
+	return f, nil
+}
+
+// appender - file opened for append, WriteAt of memfs.Handle
+// refuses such files so writes go through Write
+type appender struct {
+	*memfs.Handle
+}
+
+// WriteAt appends p to the file, off is ignored
+func (a appender) WriteAt(p []byte, off int64) (int, error) {
+	return a.Write(p)
+}
+
+// Filecmd runs commands changing the tree
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	var err error
+	switch r.Method {
+	case "Setstat":
+		err = h.setstat(r)
+	case "Rename":
+		// SFTP rename doesn't replace an existing file
+		if _, err := h.fs.Lstat(r.Target); err == nil {
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EEXIST}
+		}
+		err = h.fs.Rename(r.Filepath, r.Target)
+	case "Rmdir":
+		err = h.fs.RemoveDir(r.Filepath)
+	case "Mkdir":
+		err = h.mkdir(r)
+	case "Link":
+		err = h.fs.Link(r.Filepath, r.Target)
+	case "Symlink":
+		// target of the link is Filepath, kept as the client sent it
+		err = h.fs.Symlink(r.Filepath, r.Target)
+	case "Remove":
+		err = h.fs.Unlink(r.Filepath)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return status(err)
+}
+
+// PosixRename moves file replacing the existing one
+func (h *handlers) PosixRename(r *sftp.Request) error {
+	return status(h.fs.Rename(r.Filepath, r.Target))
+}
+
+// setstat changes attributes passed with r. Owner is changed
+// ahead of mode as chown clears setuid and setgid bits
+func (h *handlers) setstat(r *sftp.Request) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := h.fs.Truncate(r.Filepath, int(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := h.fs.Chown(r.Filepath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		mode := attrs.FileMode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := h.fs.Chmod(r.Filepath, mode); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		if err := h.fs.Chtimes(r.Filepath, atime, attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdir creates directory of r, its parent must exist.
+// Mode is 0777 masked with umask, the request carries no attributes
+func (h *handlers) mkdir(r *sftp.Request) error {
+	name := r.Filepath
+	parent, err := h.fs.IOFS().Stat(iopath(path.Dir(name)))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if _, err := h.fs.Lstat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST}
+	}
+
+	return h.fs.Mkdir(name)
+}
+
+// Filelist lists directory or stats file of r, symlinks are followed
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.fs.IOFS().ReadDir(iopath(r.Filepath))
+		if err != nil {
+			return nil, status(err)
+		}
+		infos := make(lister, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, status(err)
+			}
+			infos = append(infos, fileInfo{info})
+		}
+		return infos, nil
+	case "Stat":
+		info, err := h.fs.IOFS().Stat(iopath(r.Filepath))
+		if err != nil {
+			return nil, status(err)
+		}
+		return lister{fileInfo{info}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat stats file of r, a symlink itself is described
+func (h *handlers) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := h.fs.Lstat(r.Filepath)
+	if err != nil {
+		return nil, status(err)
+	}
+	return lister{fileInfo{info}}, nil
+}
+
+// Readlink returns target of symlink name
+func (h *handlers) Readlink(name string) (string, error) {
+	target, err := h.fs.Readlink(name)
+	return target, status(err)
+}
+
+// lister - listing returned to the request server
+type lister []os.FileInfo
+
+// ListAt copies entries from offset to ls
+func (l lister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileInfo reports owner of a MemFS file to the request server
+type fileInfo struct {
+	os.FileInfo
+}
+
+// Uid of the file owner
+func (i fileInfo) Uid() uint32 {
+	if o, ok := i.FileInfo.(interface{ Uid() int }); ok {
+		return uint32(o.Uid())
+	}
+	return 0
+}
+
+// Gid of the file group
+func (i fileInfo) Gid() uint32 {
+	if o, ok := i.FileInfo.(interface{ Gid() int }); ok {
+		return uint32(o.Gid())
+	}
+	return 0
+}
+
+// status converts permission errors of err to EACCES, so the client
+// gets permission denied status rather than a generic failure
+func status(err error) error {
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		return &os.PathError{Op: e.Op, Path: e.Path, Err: syscall.EACCES}
+	case *os.LinkError:
+		return &os.PathError{Op: e.Op, Path: e.Old, Err: syscall.EACCES}
+	}
+	return syscall.EACCES
+}
+
+// iopath converts absolute path to the io/fs form
+func iopath(p string) string {
+	if p == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "/")
+}
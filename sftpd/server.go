@@ -0,0 +1,211 @@
+package sftpd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"fs/memfs"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config - SSH settings of a server. A client is let in if it presents
+// the password of its user or one of the keys authorized for the user
+type Config struct {
+	// HostKey identifies the server, a new ed25519 key is made if it is nil
+	HostKey ssh.Signer
+	// Passwords of users
+	Passwords map[string]string
+	// AuthorizedKeys of users
+	AuthorizedKeys map[string][]ssh.PublicKey
+}
+
+// Server - SFTP server of a MemFS over SSH. Each session serves the sftp
+// subsystem with the credential of the MemFS, user names only select
+// the password or keys a client is checked with
+type Server struct {
+	fs     *memfs.MemFS
+	config *ssh.ServerConfig
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[io.Closer]bool
+	closed    bool
+}
+
+// errClosed - server is closed
+var errClosed = &net.OpError{Op: "serve", Net: "sftp", Err: syscall.EINVAL}
+
+// NewServer creates server of fs
+func NewServer(fs *memfs.MemFS, cfg Config) (*Server, error) {
+	if len(cfg.Passwords) == 0 && len(cfg.AuthorizedKeys) == 0 {
+		return nil, errors.New("sftpd: no passwords or keys to authenticate with")
+	}
+
+	hostKey := cfg.HostKey
+	if hostKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if hostKey, err = ssh.NewSignerFromKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	config := &ssh.ServerConfig{}
+	if len(cfg.Passwords) > 0 {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			want, ok := cfg.Passwords[c.User()]
+			if ok && subtle.ConstantTimeCompare([]byte(want), password) == 1 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("sftpd: password rejected for %q", c.User())
+		}
+	}
+	if len(cfg.AuthorizedKeys) > 0 {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range cfg.AuthorizedKeys[c.User()] {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("sftpd: unknown public key for %q", c.User())
+		}
+	}
+	config.AddHostKey(hostKey)
+
+	return &Server{
+		fs:        fs,
+		config:    config,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[io.Closer]bool),
+	}, nil
+}
+
+// Serve accepts connections of l and serves each of them in its own
+// goroutine, returns when l fails or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return errClosed
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn runs SSH handshake on c and serves its sessions
+// until the client disconnects
+func (s *Server) ServeConn(c net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return errClosed
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	sc, chans, reqs, err := ssh.NewServerConn(c, s.config)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.session(ch, requests)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// session serves the sftp subsystem requested on ch,
+// other requests of the session are declined
+func (s *Server) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range requests {
+		var subsystem struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &subsystem) != nil || subsystem.Name != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		srv := sftp.NewRequestServer(ch, Handlers(s.fs))
+		code := uint32(0)
+		if err := srv.Serve(); err != nil && err != io.EOF {
+			code = 1
+		}
+		srv.Close()
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
+		return
+	}
+}
+
+// Close stops all listeners and connections of the server
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
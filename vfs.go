@@ -0,0 +1,633 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// MountOptions - settings of a single mount
+type MountOptions struct {
+	// ReadOnly - changes fail with EROFS
+	ReadOnly bool
+	// Source - where the filesystem comes from, shown by Mounts
+	Source string
+}
+
+// MountPoint - filesystem mounted at Path
+type MountPoint struct {
+	Path    string
+	FS      Filesystem
+	Options MountOptions
+}
+
+// VFS joins filesystems mounted at paths into one namespace.
+// Paths are made absolute against the working directory and cleaned,
+// then the mount with the longest matching path gets the rest of the path.
+// So ".." crosses mount points lexically, while symlinks are resolved
+// by the filesystem holding them and stay inside it.
+// Operations beyond Filesystem are passed on to filesystems having them,
+// others fail with ENOTSUP
+type VFS struct {
+	mu sync.RWMutex
+	// mounts sorted by path
+	mounts []*MountPoint
+	wd     string
+	files  []*vfile
+}
+
+// vfile - descriptor of the namespace mapped to the one of a filesystem
+type vfile struct {
+	mount *MountPoint
+	fd    int
+}
+
+// NewVFS creates an empty namespace, "/" has to be mounted first
+func NewVFS() *VFS {
+	return &VFS{wd: "/"}
+}
+
+// Mount attaches fs at path. Path must be an existing directory
+// unless it is "/", a path can't be mounted twice
+func (v *VFS) Mount(path string, fs Filesystem, opts MountOptions) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	path = v.abs(path)
+	if v.mounted(path) != nil {
+		return &os.PathError{Op: "mount", Path: path, Err: syscall.EBUSY}
+	}
+	if path != "/" {
+		m, rel, err := v.resolve("mount", path)
+		if err != nil {
+			return err
+		}
+		if st, ok := m.FS.(interface {
+			Lstat(string) (os.FileInfo, error)
+		}); ok {
+			info, err := st.Lstat(rel)
+			if err != nil {
+				return &os.PathError{Op: "mount", Path: path, Err: syscall.ENOENT}
+			}
+			if !info.IsDir() {
+				return &os.PathError{Op: "mount", Path: path, Err: syscall.ENOTDIR}
+			}
+		}
+	}
+
+	v.mounts = append(v.mounts, &MountPoint{Path: path, FS: fs, Options: opts})
+	sort.Slice(v.mounts, func(i, j int) bool {
+		return v.mounts[i].Path < v.mounts[j].Path
+	})
+	return nil
+}
+
+// Umount detaches filesystem mounted at path. It is busy while it has
+// open descriptors, mounts below it or holds the working directory.
+// release is called with the filesystem before it is detached,
+// if it fails the filesystem stays mounted
+func (v *VFS) Umount(path string, release func(fs Filesystem) error) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	path = v.abs(path)
+	m := v.mounted(path)
+	if m == nil {
+		return &os.PathError{Op: "umount", Path: path, Err: syscall.EINVAL}
+	}
+
+	for _, other := range v.mounts {
+		if other != m && within(other.Path, path) {
+			return &os.PathError{Op: "umount", Path: path, Err: syscall.EBUSY}
+		}
+	}
+	for _, f := range v.files {
+		if f != nil && f.mount == m {
+			return &os.PathError{Op: "umount", Path: path, Err: syscall.EBUSY}
+		}
+	}
+	if path != "/" && within(v.wd, path) {
+		return &os.PathError{Op: "umount", Path: path, Err: syscall.EBUSY}
+	}
+
+	if release != nil {
+		if err := release(m.FS); err != nil {
+			return err
+		}
+	}
+	for i := range v.mounts {
+		if v.mounts[i] == m {
+			v.mounts = append(v.mounts[:i], v.mounts[i+1:]...)
+			break
+		}
+	}
+	if len(v.mounts) == 0 {
+		v.wd = "/"
+	}
+	return nil
+}
+
+// Mounts returns mount table sorted by path
+func (v *VFS) Mounts() []MountPoint {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	mounts := make([]MountPoint, 0, len(v.mounts))
+	for _, m := range v.mounts {
+		mounts = append(mounts, *m)
+	}
+	return mounts
+}
+
+// Resolve returns filesystem holding name and path of name inside it
+func (v *VFS) Resolve(name string) (Filesystem, string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.resolve("resolve", name)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.FS, rel, nil
+}
+
+// abs makes name absolute and clean
+func (v *VFS) abs(name string) string {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(v.wd, name)
+	}
+	return filepath.Clean(name)
+}
+
+// within checks if path is dir or below it
+func within(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// mounted finds mount at exactly path
+func (v *VFS) mounted(path string) *MountPoint {
+	for _, m := range v.mounts {
+		if m.Path == path {
+			return m
+		}
+	}
+	return nil
+}
+
+// resolve finds mount holding name, returns absolute path of name inside it
+func (v *VFS) resolve(op, name string) (*MountPoint, string, error) {
+	path := v.abs(name)
+
+	// mounts are sorted, so the deepest matching one is the last
+	var found *MountPoint
+	for _, m := range v.mounts {
+		if within(path, m.Path) {
+			found = m
+		}
+	}
+	if found == nil {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+
+	rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, found.Path), "/")
+	return found, rel, nil
+}
+
+// change resolves name for an operation changing its filesystem
+func (v *VFS) change(op, name string) (*MountPoint, string, error) {
+	m, rel, err := v.resolve(op, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.Options.ReadOnly {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+	}
+	return m, rel, nil
+}
+
+// unsupported - error of an operation the filesystem doesn't have
+func unsupported(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.ENOTSUP}
+}
+
+// cross - error of an operation on names in different mounts
+func cross(op, oldname, newname string) error {
+	return &os.LinkError{Op: op, Old: oldname, New: newname, Err: syscall.EXDEV}
+}
+
+// Open opens file for reading and writing, returns descriptor of the namespace
+func (v *VFS) Open(name string) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	m, rel, err := v.resolve("open", name)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := m.FS.Open(rel)
+	if err != nil {
+		return 0, err
+	}
+
+	f := &vfile{mount: m, fd: fd}
+	for i, slot := range v.files {
+		if slot == nil {
+			v.files[i] = f
+			return i, nil
+		}
+	}
+	v.files = append(v.files, f)
+	return len(v.files) - 1, nil
+}
+
+// file returns open file of descriptor fd
+func (v *VFS) file(fd int) (*vfile, error) {
+	if fd < 0 || fd >= len(v.files) || v.files[fd] == nil {
+		return nil, os.ErrClosed
+	}
+	return v.files[fd], nil
+}
+
+// Close releases descriptor fd
+func (v *VFS) Close(fd int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	f, err := v.file(fd)
+	if err != nil {
+		return err
+	}
+	if c, ok := f.mount.FS.(interface{ Close(int) error }); ok {
+		if err := c.Close(f.fd); err != nil {
+			return err
+		}
+	}
+
+	v.files[fd] = nil
+	for len(v.files) > 0 && v.files[len(v.files)-1] == nil {
+		v.files = v.files[:len(v.files)-1]
+	}
+	return nil
+}
+
+// Read reads size bytes at off of the open file
+func (v *VFS) Read(fd, off, size int) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	f, err := v.file(fd)
+	if err != nil {
+		return "", err
+	}
+	return f.mount.FS.Read(f.fd, off, size)
+}
+
+// Write writes data at off of the open file
+func (v *VFS) Write(fd, off, size int, data string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	f, err := v.file(fd)
+	if err != nil {
+		return "", err
+	}
+	if f.mount.Options.ReadOnly {
+		return "", syscall.EROFS
+	}
+	return f.mount.FS.Write(f.fd, off, size, data)
+}
+
+// Create creates file name
+func (v *VFS) Create(name string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("create", name)
+	if err != nil {
+		return err
+	}
+	return m.FS.Create(rel)
+}
+
+// Cd changes working directory, filesystems without Cd can only be
+// entered at their root
+func (v *VFS) Cd(path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	m, rel, err := v.resolve("cd", path)
+	if err != nil {
+		return err
+	}
+	if fs, ok := m.FS.(interface{ Cd(string) error }); ok {
+		if err := fs.Cd(rel); err != nil {
+			return err
+		}
+	} else if rel != "/" {
+		return unsupported("cd", path)
+	}
+
+	v.wd = v.abs(path)
+	return nil
+}
+
+// Pwd returns working directory
+func (v *VFS) Pwd() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.wd
+}
+
+// List returns files of the working directory
+func (v *VFS) List() []File {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.resolve("list", v.wd)
+	if err != nil {
+		return nil
+	}
+	// working directory of the filesystem is its own,
+	// it may be mounted more than once or used on its own
+	if fs, ok := m.FS.(interface {
+		ListDir(string) ([]File, error)
+	}); ok {
+		files, err := fs.ListDir(rel)
+		if err != nil {
+			return nil
+		}
+		return files
+	}
+	// others are listed from their working directory, moved there and back
+	if fs, ok := m.FS.(interface{ Cd(string) error }); ok {
+		wd := m.FS.Pwd()
+		if err := fs.Cd(rel); err != nil {
+			return nil
+		}
+		defer fs.Cd(wd)
+	}
+	return m.FS.List()
+}
+
+// Stat returns file id of the filesystem holding the working directory
+func (v *VFS) Stat(id int) (File, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, _, err := v.resolve("stat", v.wd)
+	if err != nil {
+		return nil, err
+	}
+	return m.FS.Stat(id)
+}
+
+// Mkdir creates directory name
+func (v *VFS) Mkdir(name string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("mkdir", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Mkdir(string) error })
+	if !ok {
+		return unsupported("mkdir", name)
+	}
+	return fs.Mkdir(rel)
+}
+
+// Lstat returns stats of name, symlinks aren't followed
+func (v *VFS) Lstat(name string) (os.FileInfo, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	fs, ok := m.FS.(interface {
+		Lstat(string) (os.FileInfo, error)
+	})
+	if !ok {
+		return nil, unsupported("lstat", name)
+	}
+	return fs.Lstat(rel)
+}
+
+// Cat returns data of file name
+func (v *VFS) Cat(name string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.resolve("cat", name)
+	if err != nil {
+		return "", err
+	}
+	fs, ok := m.FS.(interface {
+		Cat(string) (string, error)
+	})
+	if !ok {
+		return "", unsupported("cat", name)
+	}
+	return fs.Cat(rel)
+}
+
+// Readlink returns destination of symlink name
+func (v *VFS) Readlink(name string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.resolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	fs, ok := m.FS.(interface {
+		Readlink(string) (string, error)
+	})
+	if !ok {
+		return "", unsupported("readlink", name)
+	}
+	return fs.Readlink(rel)
+}
+
+// Truncate changes size of file name
+func (v *VFS) Truncate(name string, size int) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("truncate", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Truncate(string, int) error })
+	if !ok {
+		return unsupported("truncate", name)
+	}
+	return fs.Truncate(rel, size)
+}
+
+// Chmod changes mode of file name
+func (v *VFS) Chmod(name string, mode os.FileMode) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("chmod", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface {
+		Chmod(string, os.FileMode) error
+	})
+	if !ok {
+		return unsupported("chmod", name)
+	}
+	return fs.Chmod(rel, mode)
+}
+
+// Chown changes owner and group of file name
+func (v *VFS) Chown(name string, uid, gid int) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("chown", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Chown(string, int, int) error })
+	if !ok {
+		return unsupported("chown", name)
+	}
+	return fs.Chown(rel, uid, gid)
+}
+
+// Unlink removes file name
+func (v *VFS) Unlink(name string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.removal("unlink", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Unlink(string) error })
+	if !ok {
+		return unsupported("unlink", name)
+	}
+	return fs.Unlink(rel)
+}
+
+// Remove removes file name
+func (v *VFS) Remove(name string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.removal("remove", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Remove(string) error })
+	if !ok {
+		return unsupported("remove", name)
+	}
+	return fs.Remove(rel)
+}
+
+// RemoveDir removes empty directory name
+func (v *VFS) RemoveDir(name string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.removal("rmdir", name)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ RemoveDir(string) error })
+	if !ok {
+		return unsupported("rmdir", name)
+	}
+	return fs.RemoveDir(rel)
+}
+
+// removal resolves name for removing it, mount points can't be removed
+func (v *VFS) removal(op, name string) (*MountPoint, string, error) {
+	if v.mounted(v.abs(name)) != nil {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.EBUSY}
+	}
+	return v.change(op, name)
+}
+
+// pair resolves names of an operation on two names, they must be
+// in the same mount
+func (v *VFS) pair(op, oldname, newname string) (*MountPoint, string, string, error) {
+	m, oldrel, err := v.change(op, oldname)
+	if err != nil {
+		return nil, "", "", err
+	}
+	other, newrel, err := v.change(op, newname)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if m != other {
+		return nil, "", "", cross(op, oldname, newname)
+	}
+	return m, oldrel, newrel, nil
+}
+
+// Link creates hard link name2 to name1, both must be in the same mount
+func (v *VFS) Link(name1, name2 string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel1, rel2, err := v.pair("link", name1, name2)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Link(string, string) error })
+	if !ok {
+		return unsupported("link", name2)
+	}
+	return fs.Link(rel1, rel2)
+}
+
+// Rename moves oldname to newname, both must be in the same mount
+// and mount points can't be moved
+func (v *VFS) Rename(oldname, newname string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	for _, name := range []string{oldname, newname} {
+		if v.mounted(v.abs(name)) != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EBUSY}
+		}
+	}
+	m, oldrel, newrel, err := v.pair("rename", oldname, newname)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Rename(string, string) error })
+	if !ok {
+		return unsupported("rename", oldname)
+	}
+	return fs.Rename(oldrel, newrel)
+}
+
+// Symlink creates newname as symlink to oldname. oldname is stored as is
+// and resolved by the filesystem holding the link
+func (v *VFS) Symlink(oldname, newname string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	m, rel, err := v.change("symlink", newname)
+	if err != nil {
+		return err
+	}
+	fs, ok := m.FS.(interface{ Symlink(string, string) error })
+	if !ok {
+		return unsupported("symlink", newname)
+	}
+	return fs.Symlink(oldname, rel)
+}
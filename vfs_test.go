@@ -0,0 +1,52 @@
+package fs_test
+
+import (
+	"sort"
+	"testing"
+
+	vfs "fs"
+	"fs/memfs"
+)
+
+func TestListKeepsWorkingDirectory(t *testing.T) {
+	root, mnt := memfs.Create(), memfs.Create()
+	for _, dir := range []string{"/mnt", "/tmp"} {
+		if err := root.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"/x/a", "/y/b", "/y/c"} {
+		if err := mnt.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mnt.Cd("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	v := vfs.NewVFS()
+	if err := v.Mount("/", root, vfs.MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Mount("/mnt", mnt, vfs.MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Cd("/mnt/y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.Cd("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range v.List() {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "b" || names[1] != "c" {
+		t.Errorf("listed %v, want [b c]", names)
+	}
+	if wd := mnt.Pwd(); wd != "/x" {
+		t.Errorf("working directory of the mounted filesystem moved to %s", wd)
+	}
+}